@@ -0,0 +1,98 @@
+package main
+
+// AhoCorasick finds which of a set of patterns appear in a text, in a single pass over the text.
+type AhoCorasick struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next   map[byte]int32
+	fail   int32 // the node for the longest proper suffix that is also in the trie
+	output int32 // the nearest node (this one or through fail) that ends a pattern, or -1
+	ends   []int // the patterns ending here
+}
+
+// NewAhoCorasick builds a matcher for patterns. Blank patterns never match.
+func NewAhoCorasick(patterns []string) *AhoCorasick {
+	ac := &AhoCorasick{nodes: []acNode{{next: make(map[byte]int32), output: -1}}}
+
+	for i, p := range patterns {
+		if p == "" {
+			continue
+		}
+		cur := int32(0)
+		for j := 0; j < len(p); j++ {
+			nxt, ok := ac.nodes[cur].next[p[j]]
+			if !ok {
+				nxt = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{next: make(map[byte]int32), output: -1})
+				ac.nodes[cur].next[p[j]] = nxt
+			}
+			cur = nxt
+		}
+		ac.nodes[cur].ends = append(ac.nodes[cur].ends, i)
+	}
+
+	// Breadth-first, so every node's fail is set before its children's
+	queue := []int32{}
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		n := &ac.nodes[cur]
+		if len(n.ends) > 0 {
+			n.output = cur
+		} else {
+			n.output = ac.nodes[n.fail].output
+		}
+
+		for b, child := range n.next {
+			f := n.fail
+			for {
+				if nxt, ok := ac.nodes[f].next[b]; ok && nxt != child {
+					ac.nodes[child].fail = nxt
+					break
+				}
+				if f == 0 {
+					ac.nodes[child].fail = 0
+					break
+				}
+				f = ac.nodes[f].fail
+			}
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// Match returns the indexes of the patterns found in text, each only once, in the order they were first found.
+func (ac *AhoCorasick) Match(text string) []int {
+	found := []int{}
+	seen := make(map[int]bool)
+	cur := int32(0)
+	for i := 0; i < len(text); i++ {
+		for {
+			if nxt, ok := ac.nodes[cur].next[text[i]]; ok {
+				cur = nxt
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = ac.nodes[cur].fail
+		}
+
+		for out := ac.nodes[cur].output; out > 0; out = ac.nodes[ac.nodes[out].fail].output {
+			for _, p := range ac.nodes[out].ends {
+				if !seen[p] {
+					seen[p] = true
+					found = append(found, p)
+				}
+			}
+		}
+	}
+	return found
+}
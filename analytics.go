@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/jackc/pgtype"
-	"go.uber.org/zap"
 )
 
 type SearchAnalytic struct {
+	SearchId       uuid.UUID // identifies the search to clients, see FromSuggestion
 	UserId         uuid.UUID
 	Type           SearchType
 	Time           time.Time
@@ -20,13 +21,117 @@ type SearchAnalytic struct {
 	QueryProcessed string
 	QueryLocation  pgtype.Int4
 	QueryType      string
+
+	// Suggestions
+	Suggested      bool        // suggestions were returned, because there were no results
+	FromSuggestion pgtype.UUID // the SearchId of the search whose suggestion was followed to make this one
+
+	// VariantsMatched are the scripts of the transliterated query variants that matched any results.
+	VariantsMatched []Script
 }
 
-func (s *Server) AddSearchAnalytic(sa *SearchAnalytic) {
-	_, err := s.conn.Exec(context.Background(), "INSERT INTO data_searches (user_id, search_type, time, duration, num_returned, error, query_raw, query_processed, query_location, query_type) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
-		sa.UserId, sa.Type, sa.Time, sa.Duration, sa.NumReturned, sa.Error, sa.QueryRaw, sa.QueryProcessed, sa.QueryLocation, sa.QueryType)
+// NewSearchId returns a new random SearchId.
+func NewSearchId() uuid.UUID {
+	id, err := uuid.NewV4()
 	if err != nil {
-		s.logger.Error("error inserting into data_searches", zap.Error(err))
+		return uuid.Nil
+	}
+	return id
+}
+
+// AddVariant records that a result was matched by the variant in script, if the query was transliterated.
+func (sa *SearchAnalytic) AddVariant(script Script) {
+	if script == "" {
 		return
 	}
+	for _, sc := range sa.VariantsMatched {
+		if sc == script {
+			return
+		}
+	}
+	sa.VariantsMatched = append(sa.VariantsMatched, script)
+}
+
+// Table implements AnalyticEvent.
+func (sa *SearchAnalytic) Table() string {
+	return "data_searches"
+}
+
+// Columns implements AnalyticEvent.
+func (sa *SearchAnalytic) Columns() []string {
+	return []string{"search_uuid", "user_id", "search_type", "time", "duration", "num_returned", "error", "query_raw", "query_processed", "query_location", "query_type", "variants_matched", "suggested", "from_suggestion"}
+}
+
+// Values implements AnalyticEvent.
+func (sa *SearchAnalytic) Values() []interface{} {
+	variants := pgtype.Text{Status: pgtype.Null}
+	if len(sa.VariantsMatched) > 0 {
+		scripts := []string{}
+		for _, sc := range sa.VariantsMatched {
+			scripts = append(scripts, string(sc))
+		}
+		variants = pgtype.Text{String: strings.Join(scripts, ","), Status: pgtype.Present}
+	}
+	return []interface{}{sa.SearchId, sa.UserId, sa.Type, sa.Time, sa.Duration, sa.NumReturned, sa.Error, sa.QueryRaw, sa.QueryProcessed, sa.QueryLocation, sa.QueryType, variants, sa.Suggested, sa.FromSuggestion}
+}
+
+// AddSearchAnalytic queues a search to be recorded. It never blocks.
+func (s *Server) AddSearchAnalytic(sa *SearchAnalytic) {
+	s.analytics.Add(sa)
+}
+
+// SearchMeasurement records how one part of a search went: a location's name file, or the whole extended search.
+type SearchMeasurement struct {
+	SearchId    uuid.UUID
+	Tier        SearchType
+	Location    pgtype.Int4 // null for ST_EXTENDED, which searches every location
+	NumReturned int
+	Duration    int  // ms
+	Cancelled   bool // the client went away
+	TimedOut    bool // the search took longer than Config.SearchTimeout
+}
+
+// Table implements AnalyticEvent.
+func (sm *SearchMeasurement) Table() string {
+	return "data_search_measurements"
+}
+
+// Columns implements AnalyticEvent.
+func (sm *SearchMeasurement) Columns() []string {
+	return []string{"search_uuid", "search_type", "location_id", "num_returned", "duration", "cancelled", "timed_out"}
+}
+
+// Values implements AnalyticEvent.
+func (sm *SearchMeasurement) Values() []interface{} {
+	return []interface{}{sm.SearchId, sm.Tier, sm.Location, sm.NumReturned, sm.Duration, sm.Cancelled, sm.TimedOut}
+}
+
+// Measure runs a search of loc (nil for every location), which returns how many entries it found, recording a SearchMeasurement of it.
+func (s *Server) Measure(ctx context.Context, searchId uuid.UUID, tier SearchType, loc *Location, search func() (int, bool)) (int, bool) {
+	start := time.Now()
+	num, ok := search()
+	s.AddMeasurement(ctx, searchId, tier, loc, num, start)
+	return num, ok
+}
+
+// AddMeasurement records a SearchMeasurement of a search of loc (nil for every location) that started at start and found num entries.
+// It's for searches that can't be wrapped by Measure, such as several run together.
+func (s *Server) AddMeasurement(ctx context.Context, searchId uuid.UUID, tier SearchType, loc *Location, num int, start time.Time) {
+	sm := &SearchMeasurement{
+		SearchId:    searchId,
+		Tier:        tier,
+		Location:    pgtype.Int4{Status: pgtype.Null},
+		NumReturned: num,
+		Duration:    int(time.Since(start).Milliseconds()),
+	}
+	if loc != nil {
+		sm.Location = pgtype.Int4{Int: int32(loc.ID), Status: pgtype.Present}
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		sm.Cancelled = true
+	case context.DeadlineExceeded:
+		sm.TimedOut = true
+	}
+	s.analytics.Add(sm)
 }
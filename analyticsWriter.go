@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Analytics sinks
+const (
+	AS_POSTGRES string = "postgres"
+	AS_FILE     string = "file" // JSON Lines, appended to Config.AnalyticsFile
+	AS_STDOUT   string = "stdout"
+)
+
+// ANALYTICS_REPLAY_TIMEOUT is how long replaying the spill file on startup can take.
+const ANALYTICS_REPLAY_TIMEOUT = 10 * time.Minute
+
+// ANALYTICS_RETRIES is how many times writing a batch to a sink is retried before it is spilled.
+const ANALYTICS_RETRIES int = 3
+
+// AnalyticEvent is a row to be recorded in one of the data_ tables.
+// Every event for the same table must have the same columns.
+type AnalyticEvent interface {
+	Table() string
+	Columns() []string
+	Values() []interface{}
+}
+
+// AnalyticsSink is somewhere that analytics are written to.
+type AnalyticsSink interface {
+	Name() string
+	Write(ctx context.Context, events []AnalyticEvent) error
+	Close() error
+}
+
+// postgresSink copies events into their tables.
+type postgresSink struct {
+	conn *pgxpool.Pool
+}
+
+func (p *postgresSink) Name() string {
+	return AS_POSTGRES
+}
+
+func (p *postgresSink) Write(ctx context.Context, events []AnalyticEvent) error {
+	byTable := make(map[string][][]interface{})
+	columns := make(map[string][]string)
+	tables := []string{}
+	for _, e := range events {
+		table := e.Table()
+		if _, ok := byTable[table]; !ok {
+			tables = append(tables, table)
+			columns[table] = e.Columns()
+		}
+		byTable[table] = append(byTable[table], e.Values())
+	}
+
+	for _, table := range tables {
+		_, err := p.conn.CopyFrom(ctx, pgx.Identifier{table}, columns[table], pgx.CopyFromRows(byTable[table]))
+		if err != nil {
+			return fmt.Errorf("copying into %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (p *postgresSink) Close() error {
+	return nil
+}
+
+// jsonlSink writes each event as a line of JSON: {"table": ..., "row": {column: value}}.
+type jsonlSink struct {
+	name   string
+	path   string // "" if not a file
+	w      io.Writer
+	closer io.Closer // nil if the writer shouldn't be closed
+}
+
+// AnalyticsRecord is how an AnalyticEvent is written by the file and stdout sinks.
+// In the spill file, it also has the sinks that failed to write it.
+type AnalyticsRecord struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+	Sinks []string               `json:"sinks,omitempty"`
+}
+
+// NewAnalyticsRecord creates the AnalyticsRecord of an event.
+func NewAnalyticsRecord(e AnalyticEvent) AnalyticsRecord {
+	rec := AnalyticsRecord{Table: e.Table(), Row: make(map[string]interface{})}
+	values := e.Values()
+	for i, col := range e.Columns() {
+		rec.Row[col] = values[i]
+	}
+	return rec
+}
+
+// openJSONLSink opens a file to append analytics to, creating it if needed.
+func openJSONLSink(name, path string) (*jsonlSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{name: name, path: path, w: f, closer: f}, nil
+}
+
+func (j *jsonlSink) Name() string {
+	return j.name
+}
+
+func (j *jsonlSink) Write(ctx context.Context, events []AnalyticEvent) error {
+	records := make([]AnalyticsRecord, len(events))
+	for i, e := range events {
+		records[i] = NewAnalyticsRecord(e)
+	}
+	return j.writeRecords(records)
+}
+
+// writeRecords writes records as they are, such as ones read back from the spill file.
+func (j *jsonlSink) writeRecords(records []AnalyticsRecord) error {
+	bw := bufio.NewWriter(j.w)
+	enc := json.NewEncoder(bw)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (j *jsonlSink) Close() error {
+	if j.closer == nil {
+		return nil
+	}
+	return j.closer.Close()
+}
+
+// AnalyticsStats are counts of events since the server started.
+type AnalyticsStats struct {
+	Queued        uint64 `json:"queued"`
+	Dropped       uint64 `json:"dropped"` // because the queue was full
+	Written       uint64 `json:"written"` // to every sink
+	Failed        uint64 `json:"failed"`  // to at least one sink, after retrying
+	Spilled       uint64 `json:"spilled"` // written to the spill file after failing
+	QueueLength   int    `json:"queue_length"`
+	QueueCapacity int    `json:"queue_capacity"`
+}
+
+// AnalyticsWriter records analytics in the background, in batches, so that requests never wait on a sink.
+// Events are dropped (and counted) if the queue is full. Batches that a sink fails to write are appended to the spill file.
+type AnalyticsWriter struct {
+	// Updated atomically, and first so they're 64-bit aligned
+	queued, dropped, written, failed, spilled uint64
+
+	logger        *zap.Logger
+	sinks         []AnalyticsSink
+	spill         *jsonlSink // nil if disabled
+	spillMux      sync.Mutex // held while writing to or rewriting the spill file
+	batchSize     int
+	flushInterval time.Duration
+
+	queue     chan AnalyticEvent
+	closedMux sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+// NewAnalyticsWriter starts writing analytics to sinks.
+func NewAnalyticsWriter(logger *zap.Logger, sinks []AnalyticsSink, spill *jsonlSink, queueSize, batchSize int, flushInterval time.Duration) *AnalyticsWriter {
+	aw := &AnalyticsWriter{
+		logger:        logger,
+		sinks:         sinks,
+		spill:         spill,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan AnalyticEvent, queueSize),
+		done:          make(chan struct{}),
+	}
+	go aw.run()
+	return aw
+}
+
+// Add queues an event to be written. It never blocks; if the queue is full, the event is dropped.
+func (aw *AnalyticsWriter) Add(e AnalyticEvent) {
+	aw.closedMux.RLock()
+	defer aw.closedMux.RUnlock()
+	if aw.closed {
+		atomic.AddUint64(&aw.dropped, 1)
+		return
+	}
+
+	select {
+	case aw.queue <- e:
+		atomic.AddUint64(&aw.queued, 1)
+	default:
+		if atomic.AddUint64(&aw.dropped, 1)%1000 == 1 {
+			aw.logger.Warn("analytics queue full, dropping events", zap.Uint64("dropped", atomic.LoadUint64(&aw.dropped)))
+		}
+	}
+}
+
+func (aw *AnalyticsWriter) run() {
+	defer close(aw.done)
+	ticker := time.NewTicker(aw.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AnalyticEvent, 0, aw.batchSize)
+	for {
+		select {
+		case e, ok := <-aw.queue:
+			if !ok {
+				aw.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= aw.batchSize {
+				aw.flush(batch)
+				batch = make([]AnalyticEvent, 0, aw.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				aw.flush(batch)
+				batch = make([]AnalyticEvent, 0, aw.batchSize)
+			}
+		}
+	}
+}
+
+// flush writes a batch to every sink, retrying with a backoff, and spills it if any of them fail, recording which did
+// so that it's only replayed to them.
+func (aw *AnalyticsWriter) flush(batch []AnalyticEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	failed := []string{}
+	for _, sink := range aw.sinks {
+		var err error
+		for attempt := 0; attempt < ANALYTICS_RETRIES; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt*attempt) * 100 * time.Millisecond)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err = sink.Write(ctx, batch)
+			cancel()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			aw.logger.Error("error writing analytics", zap.String("sink", sink.Name()), zap.Int("num", len(batch)), zap.Error(err))
+			failed = append(failed, sink.Name())
+		}
+	}
+
+	if len(failed) == 0 {
+		atomic.AddUint64(&aw.written, uint64(len(batch)))
+		return
+	}
+	atomic.AddUint64(&aw.failed, uint64(len(batch)))
+	if aw.spill == nil {
+		return
+	}
+	records := make([]AnalyticsRecord, len(batch))
+	for i, e := range batch {
+		records[i] = NewAnalyticsRecord(e)
+		records[i].Sinks = failed
+	}
+	aw.spillMux.Lock()
+	err := aw.spill.writeRecords(records)
+	aw.spillMux.Unlock()
+	if err != nil {
+		aw.logger.Error("error spilling analytics, they are lost", zap.Int("num", len(batch)), zap.Error(err))
+		return
+	}
+	atomic.AddUint64(&aw.spilled, uint64(len(batch)))
+}
+
+// Close stops accepting events, writes everything still queued, and closes the sinks.
+func (aw *AnalyticsWriter) Close() {
+	aw.closedMux.Lock()
+	if aw.closed {
+		aw.closedMux.Unlock()
+		return
+	}
+	aw.closed = true
+	close(aw.queue)
+	aw.closedMux.Unlock()
+
+	<-aw.done
+	for _, sink := range aw.sinks {
+		if err := sink.Close(); err != nil {
+			aw.logger.Error("error closing analytics sink", zap.String("sink", sink.Name()), zap.Error(err))
+		}
+	}
+	if aw.spill != nil {
+		aw.spill.Close()
+	}
+}
+
+// Stats returns the counts of events since the server started.
+func (aw *AnalyticsWriter) Stats() AnalyticsStats {
+	return AnalyticsStats{
+		Queued:        atomic.LoadUint64(&aw.queued),
+		Dropped:       atomic.LoadUint64(&aw.dropped),
+		Written:       atomic.LoadUint64(&aw.written),
+		Failed:        atomic.LoadUint64(&aw.failed),
+		Spilled:       atomic.LoadUint64(&aw.spilled),
+		QueueLength:   len(aw.queue),
+		QueueCapacity: cap(aw.queue),
+	}
+}
+
+// spilledRecord is an AnalyticsRecord read back from the spill file.
+type spilledRecord struct {
+	Table string                     `json:"table"`
+	Row   map[string]json.RawMessage `json:"row"`
+	Sinks []string                   `json:"sinks"`
+}
+
+// record returns the AnalyticsRecord a spilled record was, as the file and stdout sinks write it.
+func (rec spilledRecord) record() AnalyticsRecord {
+	r := AnalyticsRecord{Table: rec.Table, Row: make(map[string]interface{}, len(rec.Row))}
+	for col, v := range rec.Row {
+		r.Row[col] = v
+	}
+	return r
+}
+
+// field returns a string column of a spilled record, or "" if it's null or missing.
+func (rec spilledRecord) field(column string) string {
+	var v string
+	json.Unmarshal(rec.Row[column], &v)
+	return v
+}
+
+// readSpill calls f with each record of a spill file and the line it was read from, stopping if f returns an error.
+// Lines that aren't records, such as one cut off by a crash, are skipped, and counted.
+func readSpill(r io.Reader, f func(rec spilledRecord, line []byte) error) (int, error) {
+	skipped := 0
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec spilledRecord
+			if json.Unmarshal(line, &rec) != nil || rec.Table == "" || len(rec.Row) == 0 {
+				skipped++
+			} else {
+				if line[len(line)-1] != '\n' {
+					line = append(line, '\n')
+				}
+				if err := f(rec, line); err != nil {
+					return skipped, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return skipped, nil
+		}
+		if err != nil {
+			return skipped, err
+		}
+	}
+}
+
+// ReplaySpill writes the analytics in the spill file to the sinks that failed to write them, keeping only those that
+// still couldn't be written, or whose sinks are no longer configured. It returns how many were written to every sink
+// they had failed to be. It's run on startup, before anything can be spilled again.
+// Postgres is written in one transaction, so if it fails, it's as if nothing was replayed to it.
+func (s *Server) ReplaySpill(ctx context.Context, path string, sinks []AnalyticsSink) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	byName := make(map[string]AnalyticsSink)
+	for _, sink := range sinks {
+		byName[sink.Name()] = sink
+	}
+
+	replayedPostgres := false
+	if _, ok := byName[AS_POSTGRES]; ok {
+		err := s.inTx(ctx, func(tx pgx.Tx) error {
+			_, err := readSpill(f, func(rec spilledRecord, line []byte) error {
+				if !rec.failed(AS_POSTGRES) {
+					return nil
+				}
+				columns := make([]string, 0, len(rec.Row))
+				for col := range rec.Row {
+					columns = append(columns, pgx.Identifier{col}.Sanitize())
+				}
+				list := strings.Join(columns, ", ")
+				table := pgx.Identifier{rec.Table}.Sanitize()
+				row, err := json.Marshal(rec.Row)
+				if err != nil {
+					return err
+				}
+				// jsonb_populate_record converts each column back from JSON, as Postgres would parse it
+				_, err = tx.Exec(ctx, "INSERT INTO "+table+" ("+list+") SELECT "+list+" FROM jsonb_populate_record(NULL::"+table+", $1)", row)
+				if err != nil {
+					return fmt.Errorf("replaying into %s: %w", rec.Table, err)
+				}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			s.logger.Error("error replaying spilled analytics", zap.String("sink", AS_POSTGRES), zap.Error(err))
+		} else {
+			replayedPostgres = true
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	// Then the other sinks, keeping each record for the sinks that still failed
+	kept, err := os.CreateTemp(filepath.Dir(path), "spill-*.jsonl")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(kept.Name()) // if it wasn't renamed
+	defer kept.Close()
+
+	replayed := 0
+	failed := make(map[string]bool) // sinks that failed, which aren't tried again
+	skipped, err := readSpill(f, func(rec spilledRecord, line []byte) error {
+		remaining := []string{}
+		for _, name := range rec.Sinks {
+			switch sink := byName[name].(type) {
+			case *postgresSink:
+				if !replayedPostgres {
+					remaining = append(remaining, name)
+				}
+			case *jsonlSink:
+				if failed[name] {
+					remaining = append(remaining, name)
+				} else if err := sink.writeRecords([]AnalyticsRecord{rec.record()}); err != nil {
+					s.logger.Error("error replaying spilled analytics", zap.String("sink", name), zap.Error(err))
+					failed[name] = true
+					remaining = append(remaining, name)
+				}
+			default:
+				remaining = append(remaining, name)
+			}
+		}
+		if len(remaining) == 0 {
+			replayed++
+			return nil
+		}
+		rec.Sinks = remaining
+		enc, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		_, err = kept.Write(append(enc, '\n'))
+		return err
+	})
+	if skipped > 0 {
+		s.logger.Warn("skipping invalid lines in analytics spill file", zap.Int("num", skipped), zap.String(ZAP_PATH, path))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := kept.Close(); err != nil {
+		return 0, err
+	}
+	return replayed, os.Rename(kept.Name(), path)
+}
+
+// failed returns whether a sink failed to write a spilled record.
+func (rec spilledRecord) failed(sink string) bool {
+	for _, name := range rec.Sinks {
+		if name == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteSpilled removes a user's analytics from the spill file, so they aren't written when it's replayed.
+// It returns how many were removed.
+func (aw *AnalyticsWriter) DeleteSpilled(userId uuid.UUID) (int, error) {
+	if aw.spill == nil {
+		return 0, nil
+	}
+	aw.spillMux.Lock()
+	defer aw.spillMux.Unlock()
+
+	f, err := os.Open(aw.spill.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// First find the user's searches, so their measurements can be removed too
+	id := userId.String()
+	searches := make(map[string]bool)
+	_, err = readSpill(f, func(rec spilledRecord, line []byte) error {
+		if rec.Table == "data_searches" && rec.field("user_id") == id {
+			searches[rec.field("search_uuid")] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	kept, err := os.CreateTemp(filepath.Dir(aw.spill.path), "spill-*.jsonl")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(kept.Name())
+	defer kept.Close()
+
+	removed := 0
+	_, err = readSpill(f, func(rec spilledRecord, line []byte) error {
+		if rec.field("user_id") == id || (rec.Table == "data_search_measurements" && searches[rec.field("search_uuid")]) {
+			removed++
+			return nil
+		}
+		_, err := kept.Write(line)
+		return err
+	})
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	// The spill file is held open for appending, so it's rewritten in place rather than replaced
+	if _, err := kept.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := os.Truncate(aw.spill.path, 0); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(aw.spill.w, kept); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// InstallAnalytics starts the AnalyticsWriter with the sinks in the config.
+// Anything spilled before the last shutdown is replayed to the sinks that failed to write it first.
+//
+// Depends on InstallDB.
+func (s *Server) InstallAnalytics() {
+	sinks := []AnalyticsSink{}
+	for _, name := range s.config.AnalyticsSinks {
+		switch name {
+		case AS_POSTGRES:
+			sinks = append(sinks, &postgresSink{conn: s.conn})
+		case AS_FILE:
+			sink, err := openJSONLSink(AS_FILE, s.config.AnalyticsFile)
+			if err != nil {
+				s.logger.Panic("error opening analytics file", zap.Error(err))
+			}
+			sinks = append(sinks, sink)
+		case AS_STDOUT:
+			sinks = append(sinks, &jsonlSink{name: AS_STDOUT, w: os.Stdout})
+		default:
+			s.logger.Warn("unknown analytics sink, ignoring", zap.String("sink", name))
+		}
+	}
+
+	var spill *jsonlSink
+	if s.config.AnalyticsSpillFile != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), ANALYTICS_REPLAY_TIMEOUT)
+		num, err := s.ReplaySpill(ctx, s.config.AnalyticsSpillFile, sinks)
+		cancel()
+		if err != nil {
+			s.logger.Error("error replaying analytics spill file, keeping it", zap.Error(err))
+		} else if num > 0 {
+			s.logger.Info("replayed analytics spill file", zap.Int("num", num))
+		}
+
+		spill, err = openJSONLSink("spill", s.config.AnalyticsSpillFile)
+		if err != nil {
+			s.logger.Error("error opening analytics spill file, failed analytics will be lost", zap.Error(err))
+			spill = nil
+		}
+	}
+
+	s.analytics = NewAnalyticsWriter(s.logger, sinks, spill, s.config.AnalyticsQueueSize, s.config.AnalyticsBatchSize, s.config.AnalyticsFlushInterval)
+	s.logger.Info("analytics", zap.Strings("sinks", s.config.AnalyticsSinks))
+}
+
+// AnalyticsStatsHandler returns the AnalyticsStats.
+func (s *Server) AnalyticsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	enc, err := json.Marshal(s.analytics.Stats())
+	if err != nil {
+		s.logger.DPanic("error encoding analytics stats", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(enc)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes a file through a temporary file in the same folder, which is then renamed into place.
+// Readers (and Syncthing) only ever see the old or the new file, never a partial one.
+// If write returns an error, the temporary file is removed and the original file is left untouched.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	dir, name := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+name+".*.tmp") // ignored by the watcher, see IsTempFile
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// IsAuthorized returns whether the request carries the admin token, as "Authorization: Bearer <token>".
+func (s *Server) IsAuthorized(r *http.Request) bool {
+	if s.config.AdminToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1
+}
+
+// RequireAuth wraps a handler so that it can only be used with the admin token.
+func (s *Server) RequireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.IsAuthorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(MarshalError("unauthorized"))
+			return
+		}
+		h(w, r)
+	}
+}
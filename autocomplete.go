@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	NUM_AUTOCOMPLETE int = 10
+	MAX_AUTOCOMPLETE int = 100
+	// MAX_AUTOCOMPLETE_FILE_SIZE is the largest name file (uncompressed, in bytes) that is indexed for autocomplete.
+	// The index of a file takes a few times its size in memory.
+	MAX_AUTOCOMPLETE_FILE_SIZE int64 = 64 << 20
+)
+
+// ErrAutocompleteTooLarge is returned when a name file is bigger than MAX_AUTOCOMPLETE_FILE_SIZE.
+var ErrAutocompleteTooLarge = errors.New("name file too large to index")
+
+// AutocompleteIndex holds the distinct names of a name file, sorted by their folded form for prefix lookups.
+type AutocompleteIndex struct {
+	keys  []string // Fold(names[i]), sorted
+	names []string
+}
+
+// FOLD_LETTERS are letters that don't decompose into a base letter and accents, but are folded anyway.
+var FOLD_LETTERS = strings.NewReplacer("ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "ł", "l", "đ", "d", "ð", "d", "þ", "th", "ı", "i")
+
+// Fold returns s in lower case without accents, so "Müller" becomes "muller".
+// Folding is done letter by letter, so the folded form of a prefix is a prefix of the folded form.
+func Fold(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return strings.ToLower(s)
+	}
+
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return FOLD_LETTERS.Replace(strings.ToLower(folded))
+}
+
+// BuildAutocompleteIndex reads the names of a name file into an AutocompleteIndex.
+// It gives up with ErrAutocompleteTooLarge once more than MAX_AUTOCOMPLETE_FILE_SIZE bytes have been read.
+func BuildAutocompleteIndex(path string, hasAttributes bool) (*AutocompleteIndex, error) {
+	f, err := OpenNameFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	type pair struct{ key, name string }
+	pairs := []pair{}
+	var size int64
+	err = ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+		size += int64(len(content) + len(ending))
+		if size > MAX_AUTOCOMPLETE_FILE_SIZE {
+			return false
+		}
+		name := string(content)
+		if hasAttributes {
+			name = NameColumn(name)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			return true
+		}
+		seen[name] = true
+		key := Fold(name)
+		if key == name {
+			key = name // share the memory
+		}
+		pairs = append(pairs, pair{key, name})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	} else if size > MAX_AUTOCOMPLETE_FILE_SIZE {
+		return nil, ErrAutocompleteTooLarge
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].name < pairs[j].name
+	})
+	idx := &AutocompleteIndex{keys: make([]string, len(pairs)), names: make([]string, len(pairs))}
+	for i, p := range pairs {
+		idx.keys[i], idx.names[i] = p.key, p.name
+	}
+	return idx, nil
+}
+
+// Complete returns up to num names starting with prefix, in order. If fold is set, case and accents are ignored.
+func (idx *AutocompleteIndex) Complete(prefix string, num int, fold bool) []string {
+	names := []string{}
+	key := Fold(prefix)
+	for i := sort.SearchStrings(idx.keys, key); i < len(idx.keys) && len(names) < num; i++ {
+		if !strings.HasPrefix(idx.keys[i], key) {
+			break
+		}
+		if fold || strings.HasPrefix(idx.names[i], prefix) {
+			names = append(names, idx.names[i])
+		}
+	}
+	return names
+}
+
+// BuildAutocomplete builds the AutocompleteIndex of every name file of the given locations, by diffKey.
+// Name files that are too large are left out, so autocomplete returns nothing for them.
+func (s *Server) BuildAutocomplete(folder string, locs []*Location) map[string]*AutocompleteIndex {
+	indexes := make(map[string]*AutocompleteIndex)
+	for _, loc := range locs {
+		for _, et := range ENTRY_TYPES {
+			path, ok := NameFilePath(folder, loc, et)
+			if !ok {
+				continue
+			}
+			idx, err := BuildAutocompleteIndex(path, loc.HasAttributes(et))
+			if err == ErrAutocompleteTooLarge {
+				s.logger.Info("not indexing name file for autocomplete", zap.Error(err), zap.String(ZAP_PATH, path))
+				continue
+			} else if err != nil {
+				s.logger.Error("error building autocomplete index", zap.Error(err), zap.String(ZAP_PATH, path))
+				continue
+			}
+			indexes[diffKey(loc.Abbr, et)] = idx
+		}
+	}
+	return indexes
+}
+
+// UpdateAutocomplete rebuilds the autocomplete indexes of only the given locations into ns, an unpublished copy.
+func (s *Server) UpdateAutocomplete(ns *NameState, locs []*Location) {
+	if !s.config.Autocomplete {
+		return
+	}
+	indexes := make(map[string]*AutocompleteIndex, len(ns.Autocomplete))
+	for k, idx := range ns.Autocomplete {
+		indexes[k] = idx
+	}
+	for _, loc := range locs {
+		for _, et := range ENTRY_TYPES {
+			delete(indexes, diffKey(loc.Abbr, et))
+		}
+	}
+	for k, idx := range s.BuildAutocomplete(ns.Folder, locs) {
+		indexes[k] = idx
+	}
+	ns.Autocomplete = indexes
+}
+
+// AutocompleteHandler returns the names starting with a prefix, from the indexes built at refresh.
+// fold=true ignores case and accents, and related=true includes names from the related locations too.
+func (s *Server) AutocompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Autocomplete {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(MarshalError("autocomplete is disabled"))
+		return
+	}
+
+	params := r.URL.Query()
+	prefix := params.Get("prefix")
+	if prefix == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("no 'prefix' parameter provided"))
+		return
+	}
+	ns := s.Names()
+	location, ok := ns.LookupLocationByAbbr(params.Get("location"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError(RS_INVALID_LOCATION))
+		return
+	}
+	entryType, ok := NewEntryType(params.Get("entry_type"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError(RS_INVALID_TYPE))
+		return
+	}
+
+	num := NUM_AUTOCOMPLETE
+	if n, err := strconv.Atoi(params.Get("num")); err == nil && n > 0 {
+		num = n
+	}
+	if num > MAX_AUTOCOMPLETE {
+		num = MAX_AUTOCOMPLETE
+	}
+	fold, _ := strconv.ParseBool(params.Get("fold"))
+	related, _ := strconv.ParseBool(params.Get("related"))
+
+	locs := []*Location{location}
+	if related {
+		for _, relID := range location.RelatedIds {
+			if loc, ok := ns.Locations[relID]; ok {
+				locs = append(locs, loc)
+			}
+		}
+	}
+
+	// Merge the names from each location, keeping them in order and distinct
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, loc := range locs {
+		idx, ok := ns.Autocomplete[diffKey(loc.Abbr, entryType)]
+		if !ok {
+			continue
+		}
+		for _, name := range idx.Complete(prefix, num, fold) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool { return Fold(names[i]) < Fold(names[j]) })
+	if len(names) > num {
+		names = names[:num]
+	}
+
+	enc, err := json.Marshal(names)
+	if err != nil {
+		s.logger.DPanic("error encoding autocomplete", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(enc)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
+)
+
+// MAX_BATCH_ITEMS is the most searches allowed in a single batch.
+const MAX_BATCH_ITEMS int = 10000
+
+// MAX_BATCH_BODY is the largest batch request body, in bytes.
+const MAX_BATCH_BODY int64 = 16 << 20
+
+// BatchRequest is the body of a batch search.
+type BatchRequest struct {
+	UserId string      `json:"id"`
+	Items  []BatchItem `json:"items"`
+}
+
+// BatchItem is a single search in a batch. ID is returned with its results; if blank, the item's index is used.
+// Num defaults to NUM_RESULTS, and is at most MAX_EXPORT_RESULTS.
+type BatchItem struct {
+	ID         string `json:"id"`
+	Query      string `json:"query"`
+	Location   string `json:"location"`
+	EntryType  string `json:"entry_type"`
+	Type       string `json:"type"`
+	Num        int    `json:"num"`
+	AllColumns bool   `json:"all_columns"`
+}
+
+// BatchResult is written (as a line of JSON) for each item once it has been searched.
+type BatchResult struct {
+	ID      string  `json:"id"`
+	Results []Entry `json:"results"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// batchSearch is a validated BatchItem.
+type batchSearch struct {
+	item     BatchItem
+	typ      SearchType
+	sq       SearchQuery
+	variants []QueryVariant
+	analytic *SearchAnalytic
+}
+
+// BatchSearchHandler runs many searches in one request, streaming the results back as JSON Lines.
+// Searches of the same tier, location, and entry type read the same name files, so they're run together, reading
+// each file only once. Each group has its own Config.SearchTimeout, so a slow one doesn't starve the ones after it.
+func (s *Server) BatchSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(MarshalError("batch search with POST"))
+		return
+	}
+
+	var req BatchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BATCH_BODY)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid JSON: " + err.Error()))
+		return
+	}
+	if len(req.Items) > MAX_BATCH_ITEMS {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("too many items, the maximum is " + strconv.Itoa(MAX_BATCH_ITEMS)))
+		return
+	}
+	userId := uuid.FromStringOrNil(req.UserId)
+	ns := s.Names()
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	write := func(bs *batchSearch, entries []Entry, errReason string) {
+		if entries == nil {
+			entries = []Entry{}
+		}
+		for i := range entries {
+			entries[i].Tier = bs.typ.String()
+			if bs.typ != ST_FALLBACK { // already matched against the variants of their own location
+				entries[i].Variant = MatchVariant(bs.variants, entries[i])
+			}
+			bs.analytic.AddVariant(entries[i].Variant)
+		}
+		if err := enc.Encode(BatchResult{ID: bs.item.ID, Results: entries, Error: errReason}); err != nil {
+			s.logger.Error("error writing batch result", zap.Error(err))
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		bs.analytic.NumReturned = len(entries)
+		bs.analytic.Error = errReason
+		bs.analytic.Duration = int(time.Since(bs.analytic.Time).Milliseconds())
+		s.AddSearchAnalytic(bs.analytic)
+	}
+
+	// Validate everything first, grouping searches of the same files
+	type groupKey struct {
+		typ        SearchType
+		locationID int
+		et         EntryType
+		allColumns bool
+	}
+	groups := make(map[groupKey][]*batchSearch)
+	groupOrder := []groupKey{}
+
+	for i, item := range req.Items {
+		if item.ID == "" {
+			item.ID = strconv.Itoa(i)
+		}
+		bs := &batchSearch{item: item, analytic: &SearchAnalytic{
+			SearchId:       NewSearchId(),
+			UserId:         userId,
+			Time:           time.Now(),
+			QueryLocation:  pgtype.Int4{Status: pgtype.Null},
+			FromSuggestion: pgtype.UUID{Status: pgtype.Null},
+		}}
+
+		typ, ok := NewSearchType(item.Type)
+		if !ok {
+			write(bs, nil, "invalid_search_type")
+			continue
+		}
+		bs.typ = typ
+		bs.analytic.Type = typ
+
+		sq, errReason := s.NewSearchQuery(ns, item.Query, item.Location, item.EntryType)
+		if errReason != "" {
+			write(bs, nil, errReason)
+			continue
+		}
+		bs.analytic.QueryRaw = sq.Query
+		bs.analytic.QueryLocation = pgtype.Int4{Int: int32(sq.Location.ID), Status: pgtype.Present}
+		bs.analytic.QueryType = string(sq.Type)
+		formatted, variants, err := s.FormatSearch(sq.Query, sq.Location, sq.Type)
+		if err != nil {
+			write(bs, nil, "invalid_query")
+			continue
+		}
+		sq.Query, bs.variants = formatted, variants
+		bs.analytic.QueryProcessed = sq.Query
+		bs.sq = sq
+
+		if bs.item.Num <= 0 {
+			bs.item.Num = NUM_RESULTS
+		} else if bs.item.Num > MAX_EXPORT_RESULTS {
+			bs.item.Num = MAX_EXPORT_RESULTS
+		}
+
+		key := groupKey{typ, sq.Location.ID, sq.Type, item.AllColumns}
+		if _, ok := groups[key]; !ok {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], bs)
+	}
+
+	for _, key := range groupOrder {
+		group := groups[key]
+		ctx, cancel := context.WithTimeout(r.Context(), s.config.SearchTimeout)
+		results, valid, ok := s.searchBatchGroup(ctx, ns, key.typ, group)
+		for i, bs := range group {
+			if reason := searchErrorReason(ctx); reason != "" {
+				write(bs, nil, reason)
+			} else if !ok || !valid[i] {
+				write(bs, nil, "invalid_query")
+			} else {
+				write(bs, results[i], "")
+			}
+		}
+		cancel()
+	}
+}
+
+// searchBatchGroup runs batch searches of the same tier, location, entry type, and columns together.
+// It returns the results and whether each search was valid, or false if the files couldn't be searched.
+func (s *Server) searchBatchGroup(ctx context.Context, ns *NameState, typ SearchType, group []*batchSearch) ([][]Entry, []bool, bool) {
+	loc, et, allColumns := group[0].sq.Location, group[0].sq.Type, group[0].item.AllColumns
+	queries, nums := []string{}, []int{}
+	for _, bs := range group {
+		queries = append(queries, bs.sq.Query)
+		nums = append(nums, bs.item.Num)
+	}
+
+	switch typ {
+	case ST_SPECIFIC:
+		start := time.Now()
+		results, valid, ok := s.MultiSearch(ctx, ns, queries, nums, loc, et, allColumns)
+		for i, bs := range group {
+			s.AddMeasurement(ctx, bs.analytic.SearchId, typ, loc, len(results[i]), start)
+		}
+		return results, valid, ok
+	case ST_EXTENDED:
+		start := time.Now()
+		results, valid, ok := s.ExtendedMultiSearch(ctx, ns, queries, nums, loc, et, allColumns)
+		for i, bs := range group {
+			s.AddMeasurement(ctx, bs.analytic.SearchId, typ, nil, len(results[i]), start)
+		}
+		return results, valid, ok
+	}
+
+	// Fallback searches each related location in turn, until every search has its results
+	results := make([][]Entry, len(group))
+	valid := make([]bool, len(group))
+	for i := range group {
+		results[i] = []Entry{}
+		valid[i] = true
+	}
+	for _, relId := range loc.RelatedIds {
+		relLoc := ns.Locations[relId]
+		// Each location has its own scripts and replacements, so is searched with its own variants
+		idx, relQueries, relNums, relVariants := []int{}, []string{}, []int{}, [][]QueryVariant{}
+		for i, bs := range group {
+			if !valid[i] || len(results[i]) >= bs.item.Num {
+				continue
+			}
+			query, variants, err := s.FormatSearch(bs.analytic.QueryRaw, relLoc, et)
+			if err != nil {
+				valid[i] = false
+				continue
+			}
+			idx = append(idx, i)
+			relQueries = append(relQueries, query)
+			relNums = append(relNums, bs.item.Num-len(results[i]))
+			relVariants = append(relVariants, variants)
+		}
+		if len(idx) == 0 {
+			break
+		}
+
+		start := time.Now()
+		found, relValid, ok := s.MultiSearch(ctx, ns, relQueries, relNums, relLoc, et, allColumns)
+		for j, i := range idx {
+			s.AddMeasurement(ctx, group[i].analytic.SearchId, typ, relLoc, len(found[j]), start)
+			if !relValid[j] {
+				valid[i] = false
+				continue
+			}
+			for _, e := range found[j] {
+				e.Variant = MatchVariant(relVariants[j], e)
+				results[i] = append(results[i], e)
+			}
+		}
+		if !ok || ctx.Err() != nil {
+			return results, valid, ok
+		}
+	}
+	return results, valid, true
+}
+
+// searchErrorReason returns the analytic error of a search stopped by its context: "cancelled" if the client went away,
+// "timeout" if it took longer than Config.SearchTimeout, or "" if it wasn't stopped.
+func searchErrorReason(ctx context.Context) string {
+	switch ctx.Err() {
+	case context.Canceled:
+		return "cancelled"
+	case context.DeadlineExceeded:
+		return "timeout"
+	}
+	return ""
+}
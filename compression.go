@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// COMPRESSION_SUFFIXES are the suffixes a name file may have after ".txt", in order of preference.
+// "" is the plain text file. ripgrep (with -z) and OpenNameFile can read all of them.
+var COMPRESSION_SUFFIXES = []string{"", ".gz", ".zst"}
+
+// NameFileNames returns every file name the name file of a location and type may have, in order of preference.
+func NameFileNames(c *Location, et EntryType) []string {
+	names := []string{}
+	for _, suffix := range COMPRESSION_SUFFIXES {
+		names = append(names, FileName(c, et)+suffix)
+	}
+	return names
+}
+
+// NameFilePath returns the path of the name file of a location and type in a names folder, whether it is compressed or not.
+// If no such file exists, it returns the path of the plain text file and false.
+func NameFilePath(nameFolder string, c *Location, et EntryType) (string, bool) {
+	folder := filepath.Join(nameFolder, c.Folder())
+	for _, name := range NameFileNames(c, et) {
+		path := filepath.Join(folder, name)
+		if FileExists(path) {
+			return path, true
+		}
+	}
+	return filepath.Join(folder, FileName(c, et)), false
+}
+
+// RelativeNamePath returns a path relative to a names folder, as shown to users.
+func RelativeNamePath(nameFolder, path string) string {
+	rel, err := filepath.Rel(nameFolder, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// IsCompressed returns whether a name file is compressed, based on its suffix.
+func IsCompressed(path string) bool {
+	return strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zst")
+}
+
+// OpenNameFile opens a name file for reading, transparently decompressing it.
+func OpenNameFile(path string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &gzipFile{Reader: gz, file: f}, nil
+	case strings.HasSuffix(path, ".zst"):
+		// There's no zstd decoder in the standard library, but the zstd binary is needed by ripgrep anyway
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("zstd", "-dcq", path)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &zstdFile{ReadCloser: out, cmd: cmd}, nil
+	default:
+		return os.Open(path)
+	}
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+type zstdFile struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (z *zstdFile) Close() error {
+	z.ReadCloser.Close()
+	return z.cmd.Wait()
+}
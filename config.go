@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Config holds the settings read from the environment at startup.
+type Config struct {
+	DBString string
+
+	// AdminToken must be sent as a bearer token to use the admin endpoints. They are disabled when it is empty.
+	AdminToken    string
+	MaxUploadSize int64
+
+	// StateFolder is where the server keeps its own files, such as snapshots of the names for diffs.
+	StateFolder string
+	// TrackDiffs keeps a sorted copy of every name file in StateFolder, to report the names that changed on each refresh.
+	TrackDiffs bool
+
+	// Autocomplete keeps an index of the names of every name file in memory, for /autocomplete.
+	// Files bigger than MAX_AUTOCOMPLETE_FILE_SIZE aren't indexed. While a version is being activated, both versions are indexed.
+	Autocomplete bool
+
+	// Analytics
+	AnalyticsSinks         []string // see AS_POSTGRES, AS_FILE, and AS_STDOUT
+	AnalyticsFile          string   // for AS_FILE
+	AnalyticsSpillFile     string   // where analytics that a sink failed to write are kept, "" to drop them
+	AnalyticsQueueSize     int
+	AnalyticsBatchSize     int
+	AnalyticsFlushInterval time.Duration
+	ReportCacheTTL         time.Duration // how long /analytics reports are cached
+	RequestAnalytics       bool          // record every request in data_requests, not just searches
+
+	// Analytics retention, see ApplyRetention. Days of 0 keep analytics forever.
+	AnalyticsRetentionDays  int           // analytics older than this are deleted
+	AnalyticsAnonymizeDays  int           // analytics older than this are anonymized
+	AnalyticsAnonymize      string        // see AA_HASH and AA_TRUNCATE
+	AnalyticsSalt           string        // for AA_HASH
+	AnalyticsTruncateLength int           // for AA_TRUNCATE
+	RetentionInterval       time.Duration // how often retention is applied
+
+	// SearchTimeout is how long a search can run before it is stopped.
+	SearchTimeout time.Duration
+
+	// Transliterate expands queries into the other scripts used by the location being searched.
+	Transliterate bool
+
+	// Names folder watcher
+	WatchNames    bool
+	WatchInterval time.Duration // how often the names folder is polled
+	WatchDebounce time.Duration // how long files must be unchanged before refreshing
+}
+
+// LoadConfig reads the Config from environmental variables, falling back to defaults for anything optional.
+func LoadConfig(logger *zap.Logger) Config {
+	stateFolder := envString("STATE_FOLDER", "/var/lib/indexbrain")
+	return Config{
+		DBString:      os.Getenv("DB_STRING"),
+		AdminToken:    os.Getenv("ADMIN_TOKEN"),
+		MaxUploadSize: envInt64(logger, "MAX_UPLOAD_SIZE", 8<<30),
+		StateFolder:   stateFolder,
+		TrackDiffs:    envBool(logger, "TRACK_DIFFS", false),
+		Autocomplete:  envBool(logger, "AUTOCOMPLETE", false),
+		Transliterate: envBool(logger, "TRANSLITERATE", false),
+		SearchTimeout: envDuration(logger, "SEARCH_TIMEOUT", 30*time.Second),
+
+		AnalyticsSinks:         SplitList(envString("ANALYTICS_SINKS", AS_POSTGRES)),
+		AnalyticsFile:          envString("ANALYTICS_FILE", filepath.Join(stateFolder, "analytics.jsonl")),
+		AnalyticsSpillFile:     envString("ANALYTICS_SPILL_FILE", filepath.Join(stateFolder, "analytics-spill.jsonl")),
+		AnalyticsQueueSize:     int(envInt64(logger, "ANALYTICS_QUEUE_SIZE", 10000)),
+		AnalyticsBatchSize:     int(envInt64(logger, "ANALYTICS_BATCH_SIZE", 500)),
+		AnalyticsFlushInterval: envDuration(logger, "ANALYTICS_FLUSH_INTERVAL", 2*time.Second),
+		ReportCacheTTL:         envDuration(logger, "REPORT_CACHE_TTL", time.Minute),
+		RequestAnalytics:       envBool(logger, "REQUEST_ANALYTICS", true),
+
+		AnalyticsRetentionDays:  int(envInt64(logger, "ANALYTICS_RETENTION_DAYS", 0)),
+		AnalyticsAnonymizeDays:  int(envInt64(logger, "ANALYTICS_ANONYMIZE_DAYS", 0)),
+		AnalyticsAnonymize:      envString("ANALYTICS_ANONYMIZE", AA_HASH),
+		AnalyticsSalt:           os.Getenv("ANALYTICS_SALT"),
+		AnalyticsTruncateLength: int(envInt64(logger, "ANALYTICS_TRUNCATE_LENGTH", 3)),
+		RetentionInterval:       envDuration(logger, "RETENTION_INTERVAL", 24*time.Hour),
+		WatchNames:              envBool(logger, "WATCH_NAMES", false),
+		WatchInterval:           envDuration(logger, "WATCH_INTERVAL", 5*time.Second),
+		WatchDebounce:           envDuration(logger, "WATCH_DEBOUNCE", 30*time.Second),
+	}
+}
+
+func envString(key string, def string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return def
+}
+
+func envBool(logger *zap.Logger, key string, def bool) bool {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		logger.Warn("invalid boolean in environment, using default", zap.String("key", key), zap.Error(err))
+		return def
+	}
+	return b
+}
+
+func envDuration(logger *zap.Logger, key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		logger.Warn("invalid duration in environment, using default", zap.String("key", key), zap.String("val", val))
+		return def
+	}
+	return d
+}
+
+func envInt64(logger *zap.Logger, key string, def int64) int64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		logger.Warn("invalid integer in environment, using default", zap.String("key", key), zap.Error(err))
+		return def
+	}
+	return i
+}
@@ -2,30 +2,98 @@ package main
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strings"
 
 	"go.uber.org/zap"
 )
 
-// CouldBe represents a FIXME
+// CouldBe is a hint shown when a query contains its Key, like a common misspelling and what it could be instead.
+// Keys match case-insensitively.
 type CouldBe struct {
-	Key string `json:"key"`
-	Val string `json:"val"`
+	ID       int    `json:"-"`
+	Key      string `json:"key"`
+	Val      string `json:"val"`
+	Category string `json:"category,omitempty"`
+	Priority int    `json:"priority"`
+	Scope
 }
 
+// InstallCouldBes retrieves all could-bes from the database, validates and orders them, and builds the matcher for them.
+// Invalid could-bes are logged and skipped.
+//
+// Depends on InstallLocations.
 func (s *Server) InstallCouldBes() {
-	s.cachedCouldBes = make(map[string]string)
+	couldBes := []CouldBe{}
+	invalid := []InvalidRule{}
 
-	rows, _ := s.conn.Query(context.Background(), "SELECT key, val FROM could_bes")
+	rows, _ := s.conn.Query(context.Background(), "SELECT id, key, COALESCE(val, ''), COALESCE(category, ''), priority, COALESCE(locations, ''), COALESCE(entry_types, '') FROM could_bes")
 	defer rows.Close()
 	for rows.Next() {
-		var key, val string
-		err := rows.Scan(&key, &val)
+		var cb CouldBe
+		var locations, entryTypes string
+		err := rows.Scan(&cb.ID, &cb.Key, &cb.Val, &cb.Category, &cb.Priority, &locations, &entryTypes)
 		if err != nil {
 			s.logger.DPanic("error getting couldBe", zap.Error(err))
 			continue
 		}
-		s.cachedCouldBes[key] = val
+		cb.Scope = NewScope(locations, entryTypes)
+
+		err = s.validateScope(cb.Scope)
+		if err == nil && strings.TrimSpace(cb.Key) == "" {
+			err = errors.New("blank key")
+		}
+		if err != nil {
+			s.logger.Error("invalid couldBe", zap.Int("id", cb.ID), zap.String("key", cb.Key), zap.Error(err))
+			invalid = append(invalid, InvalidRule{ID: cb.ID, Key: cb.Key, Reason: err.Error()})
+			continue
+		}
+		couldBes = append(couldBes, cb)
 	}
-	s.logger.Info("couldBes", zap.Int("num", len(s.cachedCouldBes)))
 
+	// The order they're returned in
+	sort.SliceStable(couldBes, func(i, j int) bool {
+		a, b := couldBes[i], couldBes[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if len(a.Key) != len(b.Key) {
+			return len(a.Key) > len(b.Key)
+		}
+		return a.ID < b.ID
+	})
+
+	keys := []string{}
+	for _, cb := range couldBes {
+		keys = append(keys, strings.ToLower(cb.Key))
+	}
+
+	s.cachedCouldBes = couldBes
+	s.couldBeMatcher = NewAhoCorasick(keys)
+	s.invalidCouldBes = invalid
+	s.logger.Info("couldBes", zap.Int("num", len(couldBes)), zap.Int("invalid", len(invalid)))
+}
+
+// MatchCouldBes returns the could-bes whose keys appear in the query, in order, that are in scope for the location and entry type.
+// A nil location or blank entry type matches could-bes for any, as /couldbes can be asked without them. Scope.AppliesTo
+// itself doesn't do this, since a replacement scoped to some locations should never apply to a search without one.
+func (s *Server) MatchCouldBes(query string, loc *Location, et EntryType) []CouldBe {
+	cb := []CouldBe{}
+
+	matches := s.couldBeMatcher.Match(strings.ToLower(query))
+	sort.Ints(matches)
+	for _, i := range matches {
+		scope := s.cachedCouldBes[i].Scope
+		if loc == nil {
+			scope.Locations = nil
+		}
+		if et == "" {
+			scope.EntryTypes = nil
+		}
+		if scope.AppliesTo(loc, et) {
+			cb = append(cb, s.cachedCouldBes[i])
+		}
+	}
+	return cb
 }
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DEFAULT_DIFF_LIMIT is the page size of added and removed names, unless 'limit' is given.
+const DEFAULT_DIFF_LIMIT int = 100
+
+// DIFF_SORT_CHUNK is how many names are sorted in memory at a time. Bigger name files are sorted in runs, which are
+// written to temporary files and then merged.
+const DIFF_SORT_CHUNK int = 256 * 1024
+
+// DIFF_MERGE_FANIN is how many sorted runs are merged at a time, so that huge name files don't need a file handle per run.
+// With more runs than this, they're first merged in groups into bigger runs.
+const DIFF_MERGE_FANIN int = 64
+
+// FileDiff is the names added to and removed from the name file of a location and type.
+// Added and Removed are only a page of the names; the counts are of all of them.
+type FileDiff struct {
+	Location   string     `json:"location"`
+	Type       EntryType  `json:"type"`
+	Time       *time.Time `json:"time,omitempty"` // when the change was noticed, for refresh diffs
+	NumAdded   int        `json:"num_added"`
+	NumRemoved int        `json:"num_removed"`
+	Added      []string   `json:"added,omitempty"`
+	Removed    []string   `json:"removed,omitempty"`
+}
+
+func diffKey(abbr string, et EntryType) string {
+	return abbr + "/" + string(et)
+}
+
+// SortNameFile writes the sorted, distinct names (the name column of each non-blank line) of a name file to w, one per line.
+// A missing file is an empty set. At most DIFF_SORT_CHUNK names are kept in memory, with sorted runs written to tmpDir.
+func SortNameFile(path string, w io.Writer, tmpDir string) error {
+	f, err := OpenNameFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var runs []string
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+	chunk := make([]string, 0, DIFF_SORT_CHUNK)
+	writeRun := func() error {
+		run, err := os.CreateTemp(tmpDir, ".names-run.*.tmp")
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run.Name())
+		err = writeSortedNames(run, chunk)
+		if closeErr := run.Close(); err == nil {
+			err = closeErr
+		}
+		chunk = chunk[:0]
+		return err
+	}
+
+	var runErr error
+	err = ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+		name := strings.TrimSpace(NameColumn(string(content)))
+		if name == "" {
+			return true
+		}
+		chunk = append(chunk, name)
+		if len(chunk) == DIFF_SORT_CHUNK {
+			runErr = writeRun()
+		}
+		return runErr == nil
+	})
+	if err != nil {
+		return err
+	} else if runErr != nil {
+		return runErr
+	}
+
+	if len(runs) == 0 {
+		return writeSortedNames(w, chunk)
+	}
+	if len(chunk) > 0 {
+		if err := writeRun(); err != nil {
+			return err
+		}
+	}
+
+	// Merge the runs into fewer, bigger ones until they can all be merged at once
+	pending := runs
+	for len(pending) > DIFF_MERGE_FANIN {
+		var merged []string
+		for len(pending) > 0 {
+			n := DIFF_MERGE_FANIN
+			if len(pending) < n {
+				n = len(pending)
+			}
+			group := pending[:n]
+			pending = pending[n:]
+
+			run, err := os.CreateTemp(tmpDir, ".names-run.*.tmp")
+			if err != nil {
+				return err
+			}
+			runs = append(runs, run.Name())
+			merged = append(merged, run.Name())
+			err = mergeSortedNames(run, group)
+			if closeErr := run.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			for _, path := range group {
+				os.Remove(path)
+			}
+		}
+		pending = merged
+	}
+	return mergeSortedNames(w, pending)
+}
+
+// writeSortedNames sorts names and writes each distinct one to w.
+func writeSortedNames(w io.Writer, names []string) error {
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		bw.WriteString(name)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// mergeSortedNames merges files of sorted names into w, dropping duplicates.
+func mergeSortedNames(w io.Writer, paths []string) error {
+	files := make([]*sortedNames, 0, len(paths))
+	defer func() {
+		for _, sn := range files {
+			sn.Close()
+		}
+	}()
+	h := make(namesHeap, 0, len(paths))
+	for _, path := range paths {
+		sn, err := openSortedNames(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, sn)
+		if sn.ok {
+			h = append(h, sn)
+		}
+	}
+	heap.Init(&h)
+
+	bw := bufio.NewWriter(w)
+	last, wrote := "", false
+	for len(h) > 0 {
+		next := h[0]
+		if !wrote || next.name != last {
+			bw.WriteString(next.name)
+			bw.WriteByte('\n')
+			last, wrote = next.name, true
+		}
+		if next.Next(); next.ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	for _, sn := range files {
+		if err := sn.Err(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// namesHeap orders files of sorted names by their current name, for merging.
+type namesHeap []*sortedNames
+
+func (h namesHeap) Len() int            { return len(h) }
+func (h namesHeap) Less(i, j int) bool  { return h[i].name < h[j].name }
+func (h namesHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *namesHeap) Push(x interface{}) { *h = append(*h, x.(*sortedNames)) }
+func (h *namesHeap) Pop() interface{} {
+	old := *h
+	sn := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return sn
+}
+
+// sortedNames reads a file of sorted names, as written by SortNameFile, one name at a time.
+type sortedNames struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	name    string // the current name, if ok
+	ok      bool   // false once every name has been read
+}
+
+// openSortedNames opens a file of sorted names, and reads its first name. A missing file has no names.
+func openSortedNames(path string) (*sortedNames, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &sortedNames{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sn := &sortedNames{file: f, scanner: bufio.NewScanner(f)}
+	sn.scanner.Buffer(make([]byte, 64*1024), MAX_LINE_LENGTH)
+	sn.Next()
+	return sn, nil
+}
+
+// Next reads the next name.
+func (sn *sortedNames) Next() {
+	if sn.scanner == nil {
+		return
+	}
+	sn.ok = sn.scanner.Scan()
+	sn.name = sn.scanner.Text()
+}
+
+func (sn *sortedNames) Err() error {
+	if sn.scanner == nil {
+		return nil
+	}
+	return sn.scanner.Err()
+}
+
+func (sn *sortedNames) Close() error {
+	if sn.file == nil {
+		return nil
+	}
+	return sn.file.Close()
+}
+
+// DiffSortedFiles compares two files of sorted names (see SortNameFile) in one pass, without reading either into memory.
+// It counts the names that were added and removed, and returns a page (offset, limit) of each. A missing file is an empty set.
+func DiffSortedFiles(oldPath, newPath string, offset, limit int) (FileDiff, error) {
+	var fd FileDiff
+	oldNames, err := openSortedNames(oldPath)
+	if err != nil {
+		return fd, err
+	}
+	defer oldNames.Close()
+	newNames, err := openSortedNames(newPath)
+	if err != nil {
+		return fd, err
+	}
+	defer newNames.Close()
+
+	inPage := func(n int) bool {
+		return n >= offset && n < offset+limit
+	}
+	for oldNames.ok || newNames.ok {
+		switch {
+		case !newNames.ok || (oldNames.ok && oldNames.name < newNames.name):
+			if inPage(fd.NumRemoved) {
+				fd.Removed = append(fd.Removed, oldNames.name)
+			}
+			fd.NumRemoved++
+			oldNames.Next()
+		case !oldNames.ok || newNames.name < oldNames.name:
+			if inPage(fd.NumAdded) {
+				fd.Added = append(fd.Added, newNames.name)
+			}
+			fd.NumAdded++
+			newNames.Next()
+		default:
+			oldNames.Next()
+			newNames.Next()
+		}
+	}
+	if err := oldNames.Err(); err != nil {
+		return fd, err
+	}
+	return fd, newNames.Err()
+}
+
+// DiffNameFiles compares two name files, sorting them into temporary files in tmpDir first. See DiffSortedFiles.
+func DiffNameFiles(oldPath, newPath string, tmpDir string, offset, limit int) (FileDiff, error) {
+	sorted := []string{}
+	defer func() {
+		for _, path := range sorted {
+			os.Remove(path)
+		}
+	}()
+	for _, path := range []string{oldPath, newPath} {
+		f, err := os.CreateTemp(tmpDir, ".names-sorted.*.tmp")
+		if err != nil {
+			return FileDiff{}, err
+		}
+		sorted = append(sorted, f.Name())
+		err = SortNameFile(path, f, tmpDir)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return FileDiff{}, err
+		}
+	}
+	return DiffSortedFiles(sorted[0], sorted[1], offset, limit)
+}
+
+// folderLocations returns the locations in a names folder, keyed by abbreviation.
+func folderLocations(folder string) (map[string]Location, error) {
+	dirEntries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	locations := make(map[string]Location)
+	for _, de := range dirEntries {
+		if !de.IsDir() || IsTempFile(de.Name()) {
+			continue
+		}
+		if loc, ok := NewLocation(de.Name()); ok {
+			locations[loc.Abbr] = loc
+		}
+	}
+	return locations, nil
+}
+
+// DiffFolders compares every name file of two names folders (such as two versions), returning the files that differ
+// with a page (offset, limit) of their added and removed names. If abbr or et are given, only matching files are compared.
+func DiffFolders(oldFolder, newFolder string, abbr string, et EntryType, offset, limit int) ([]FileDiff, error) {
+	oldLocations, err := folderLocations(oldFolder)
+	if err != nil {
+		return nil, err
+	}
+	newLocations, err := folderLocations(newFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	abbrs := []string{}
+	for a := range oldLocations {
+		abbrs = append(abbrs, a)
+	}
+	for a := range newLocations {
+		if _, ok := oldLocations[a]; !ok {
+			abbrs = append(abbrs, a)
+		}
+	}
+	sort.Strings(abbrs)
+
+	diffs := []FileDiff{}
+	for _, a := range abbrs {
+		if abbr != "" && a != abbr {
+			continue
+		}
+		for _, curEt := range ENTRY_TYPES {
+			if et != "" && curEt != et {
+				continue
+			}
+
+			var oldPath, newPath string // a missing location has no names
+			if loc, ok := oldLocations[a]; ok {
+				oldPath, _ = NameFilePath(oldFolder, &loc, curEt)
+			}
+			if loc, ok := newLocations[a]; ok {
+				newPath, _ = NameFilePath(newFolder, &loc, curEt)
+			}
+
+			fd, err := DiffNameFiles(oldPath, newPath, os.TempDir(), offset, limit)
+			if err != nil {
+				return nil, err
+			}
+			if fd.NumAdded > 0 || fd.NumRemoved > 0 {
+				fd.Location, fd.Type = a, curEt
+				diffs = append(diffs, fd)
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// snapshotPath returns where the sorted names of a location and type were saved at the last refresh.
+func (s *Server) snapshotPath(abbr string, et EntryType) string {
+	return filepath.Join(s.config.StateFolder, "snapshots", abbr, string(et)+".txt")
+}
+
+// previousSnapshotPath returns where the snapshot before the most recent change of a location and type is kept,
+// so that its names can be paged through.
+func (s *Server) previousSnapshotPath(abbr string, et EntryType) string {
+	return filepath.Join(s.config.StateFolder, "snapshots", abbr, string(et)+".prev.txt")
+}
+
+// UpdateDiffs compares the name files of the given locations against the snapshots saved at the previous refresh,
+// recording how many names were added and removed, and then saves new snapshots. Unchanged files are skipped.
+// Name files are sorted on disk and then compared in a single pass, so they're never read into memory.
+//
+// Must be called with refreshMux held.
+func (s *Server) UpdateDiffs(folder string, locs []*Location) {
+	if !s.config.TrackDiffs {
+		return
+	}
+
+	if s.diffStamps == nil {
+		s.diffStamps = make(map[string]fileState)
+	}
+	// On the first pass, files without a snapshot have never been seen before, so there's nothing to compare against yet.
+	// After that, a missing snapshot means the file is new.
+	initial := len(s.diffStamps) == 0
+
+	for _, loc := range locs {
+		for _, et := range ENTRY_TYPES {
+			path, _ := NameFilePath(folder, loc, et)
+			stamp := fileState{}
+			if fi, err := os.Stat(path); err == nil {
+				stamp = fileState{size: fi.Size(), modTime: fi.ModTime()}
+			}
+			if old, ok := s.diffStamps[path]; ok && old == stamp {
+				continue
+			}
+
+			snapshot := s.snapshotPath(loc.Abbr, et)
+			dir := filepath.Dir(snapshot)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				s.logger.Error("error creating snapshot folder", zap.Error(err))
+				continue
+			}
+			next := filepath.Join(dir, string(et)+".next.txt")
+			err := WriteFileAtomic(next, func(w io.Writer) error {
+				return SortNameFile(path, w, dir)
+			})
+			if err != nil {
+				s.logger.Error("error sorting names for diff", zap.Error(err), zap.String(ZAP_PATH, path))
+				continue
+			}
+
+			if initial && !FileExists(snapshot) {
+				err = os.Rename(next, snapshot)
+			} else {
+				err = s.recordDiff(loc.Abbr, et, next)
+			}
+			if err != nil {
+				s.logger.Error("error saving snapshot", zap.Error(err), zap.String(ZAP_PATH, snapshot))
+				continue
+			}
+			s.diffStamps[path] = stamp
+		}
+	}
+}
+
+// recordDiff compares the newly sorted names of a location and type (in next) against its snapshot. If they differ, the
+// change is recorded, the snapshot becomes the previous snapshot, and next becomes the snapshot. Otherwise, next is removed.
+func (s *Server) recordDiff(abbr string, et EntryType, next string) error {
+	snapshot, previous := s.snapshotPath(abbr, et), s.previousSnapshotPath(abbr, et)
+	fd, err := DiffSortedFiles(snapshot, next, 0, 0) // a missing snapshot is empty
+	if err != nil {
+		return err
+	}
+	if fd.NumAdded == 0 && fd.NumRemoved == 0 {
+		return os.Remove(next)
+	}
+
+	s.diffMux.Lock()
+	defer s.diffMux.Unlock()
+	if err := os.Remove(previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(snapshot, previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(next, snapshot); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	fd.Location, fd.Type, fd.Time = abbr, et, &now
+	if s.fileDiffs == nil {
+		s.fileDiffs = make(map[string]FileDiff)
+	}
+	s.fileDiffs[diffKey(abbr, et)] = fd
+	s.logger.Info("names changed",
+		zap.String(ZAP_LOCATION_ABBR, abbr), zap.String(ZAP_ENTRY_TYPE, string(et)),
+		zap.Int("added", fd.NumAdded), zap.Int("removed", fd.NumRemoved))
+	return nil
+}
+
+// RecentDiffs returns the most recent change to each name file matching abbr and et (if given), as noticed on refresh.
+// With detailed, a page (offset, limit) of the added and removed names is read from the snapshots.
+func (s *Server) RecentDiffs(abbr string, et EntryType, detailed bool, offset, limit int) ([]FileDiff, error) {
+	s.diffMux.RLock()
+	defer s.diffMux.RUnlock()
+
+	diffs := []FileDiff{}
+	for _, fd := range s.fileDiffs {
+		if (abbr != "" && fd.Location != abbr) || (et != "" && fd.Type != et) {
+			continue
+		}
+		if detailed {
+			page, err := DiffSortedFiles(s.previousSnapshotPath(fd.Location, fd.Type), s.snapshotPath(fd.Location, fd.Type), offset, limit)
+			if err != nil {
+				return nil, err
+			}
+			fd.Added, fd.Removed = page.Added, page.Removed
+		}
+		diffs = append(diffs, fd)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffKey(diffs[i].Location, diffs[i].Type) < diffKey(diffs[j].Location, diffs[j].Type)
+	})
+	return diffs, nil
+}
+
+// DiffHandler returns what changed in the names. By default that's the most recent change to each name file, as noticed on refresh.
+// With 'from' and 'to', two dataset versions are compared instead.
+// 'location' and 'entry_type' narrow it down to a single file, for which a page ('offset', 'limit') of the added and removed names is returned.
+func (s *Server) DiffHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	abbr := params.Get("location")
+	var et EntryType
+	if params.Get("entry_type") != "" {
+		var ok bool
+		if et, ok = NewEntryType(params.Get("entry_type")); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError("invalid type"))
+			return
+		}
+	}
+	detailed := abbr != "" && et != ""
+
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	limit, err := strconv.Atoi(params.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = DEFAULT_DIFF_LIMIT
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	if !detailed {
+		limit = 0 // only the counts
+	}
+
+	var diffs []FileDiff
+	from, to := params.Get("from"), params.Get("to")
+	if from != "" || to != "" {
+		fromFolder, ok := VersionFolder(from)
+		toFolder, ok2 := VersionFolder(to)
+		if !ok || !ok2 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError("'from' and 'to' must both be valid versions"))
+			return
+		}
+		diffs, err = DiffFolders(fromFolder, toFolder, abbr, et, offset, limit)
+		if err != nil {
+			s.logger.Error("error comparing versions", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(MarshalError("internal error"))
+			return
+		}
+	} else {
+		diffs, err = s.RecentDiffs(abbr, et, detailed, offset, limit)
+		if err != nil {
+			s.logger.Error("error reading snapshots", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(MarshalError("internal error"))
+			return
+		}
+	}
+
+	enc, err := json.Marshal(diffs)
+	if err != nil {
+		s.logger.DPanic("error encoding diffs", zap.Error(err))
+	}
+	w.Write(enc)
+}
+
+// RunDiff is the 'diff' subcommand, comparing two names folders (or version IDs). It returns the exit code.
+func RunDiff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	abbr := flags.String("location", "", "only compare this location")
+	entryType := flags.String("entry-type", "", "only compare this entry type (name, place, or other)")
+	offset := flags.Int("offset", 0, "skip this many added and removed names")
+	limit := flags.Int("limit", DEFAULT_DIFF_LIMIT, "show at most this many added and removed names (0 for counts only)")
+	asJson := flags.Bool("json", false, "print the diffs as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: diff [flags] <old folder or version> <new folder or version>")
+		return 2
+	}
+
+	var et EntryType
+	if *entryType != "" {
+		var ok bool
+		if et, ok = NewEntryType(*entryType); !ok {
+			fmt.Fprintln(os.Stderr, "invalid entry type:", *entryType)
+			return 2
+		}
+	}
+
+	folders := []string{}
+	for _, arg := range flags.Args() {
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			folders = append(folders, arg)
+		} else if folder, ok := VersionFolder(arg); ok {
+			folders = append(folders, folder)
+		} else {
+			fmt.Fprintln(os.Stderr, "not a folder or version:", arg)
+			return 2
+		}
+	}
+
+	diffs, err := DiffFolders(folders[0], folders[1], *abbr, et, *offset, *limit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error comparing:", err)
+		return 2
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(diffs)
+		return 0
+	}
+	for _, fd := range diffs {
+		fmt.Printf("%s %s: +%d -%d\n", fd.Location, fd.Type, fd.NumAdded, fd.NumRemoved)
+		for _, name := range fd.Added {
+			fmt.Println("  +", name)
+		}
+		for _, name := range fd.Removed {
+			fmt.Println("  -", name)
+		}
+	}
+	return 0
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/hex"
 )
 
 // EntryType represents the type of Entry (Name, Place, or Other).
 type EntryType string
 
+// ENTRY_TYPES lists every EntryType that has its own name file.
+var ENTRY_TYPES = [3]EntryType{EntryType("N"), EntryType("P"), EntryType("O")}
+
 // NewEntryType creates a new EntryType from a string.
 func NewEntryType(et string) (EntryType, bool) {
 	switch et {
@@ -23,16 +27,28 @@ func NewEntryType(et string) (EntryType, bool) {
 
 // Entry represents a search result.
 type Entry struct {
+	ID       string    `json:"id"` // see EntryID
 	Name     string    `json:"name"`
 	Type     EntryType `json:"type"`
 	Location *Location `json:"location"`
+	Tier     string    `json:"tier,omitempty"`    // the SearchType that found it
+	Variant  Script    `json:"variant,omitempty"` // the script of the query variant that matched, if it was transliterated
+
+	Attributes map[string]string `json:"attributes,omitempty"` // extra columns, see Location.Attributes
+
+	// Where the entry came from
+	File string `json:"file"` // relative to the names folder
+	Line int    `json:"line"`
 }
 
-// MarshalEntries takes a list of entries and encodes them into JSON.
-func MarshalEntries(e []Entry) []byte {
-	enc, err := json.Marshal(e)
-	if err != nil {
-		panic(err)
-	}
-	return enc
+// EntryID returns a stable ID for a line of a name file, derived from its location, type, and content.
+// It stays the same across refreshes (and even if the line moves), as long as the line itself is unchanged.
+func EntryID(c *Location, et EntryType, line string) string {
+	h := sha1.New()
+	h.Write([]byte(c.Abbr))
+	h.Write([]byte{0})
+	h.Write([]byte(et))
+	h.Write([]byte{0})
+	h.Write([]byte(line))
+	return hex.EncodeToString(h.Sum(nil))[:16]
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Explanation shows how a query would be processed and searched, without searching.
+type Explanation struct {
+	QueryRaw       string            `json:"query_raw"`
+	Steps          []SearchStep      `json:"steps"` // each change made to the query, in order
+	CouldBes       []CouldBe         `json:"could_bes"`
+	Variants       []QueryVariant    `json:"variants,omitempty"` // the query in each script, if it was transliterated
+	QueryProcessed string            `json:"query_processed"`    // the regular expression given to the search backend
+	Valid          bool              `json:"valid"`
+	Error          string            `json:"error,omitempty"` // why QueryProcessed is invalid
+	Tiers          []ExplanationTier `json:"tiers"`
+}
+
+// ExplanationTier is the name files that would be searched for one SearchType.
+type ExplanationTier struct {
+	Tier  string            `json:"tier"`
+	Files []ExplanationFile `json:"files"`
+}
+
+// ExplanationFile is a name file that would be searched.
+type ExplanationFile struct {
+	Location string `json:"location"` // abbreviation
+	File     string `json:"file"`     // relative to the names folder
+	Exists   bool   `json:"exists"`
+	Bytes    int64  `json:"bytes"`
+	Entries  int64  `json:"entries"`
+}
+
+// Explain processes a query like a search would, recording each step.
+func (s *Server) Explain(ns *NameState, sq SearchQuery) Explanation {
+	ex := Explanation{
+		QueryRaw: sq.Query,
+		Steps:    []SearchStep{},
+		CouldBes: s.MatchCouldBes(sq.Query, sq.Location, sq.Type),
+	}
+
+	var err error
+	ex.QueryProcessed, ex.Variants, err = s.formatSearch(sq.Query, sq.Location, sq.Type, &ex.Steps)
+	if err != nil {
+		ex.Error = err.Error()
+	} else if _, err := CompileQuery(ex.QueryProcessed); err != nil {
+		ex.Error = err.Error()
+	} else {
+		ex.Valid = true
+	}
+
+	file := func(loc *Location) ExplanationFile {
+		path, exists := NameFilePath(ns.Folder, loc, sq.Type)
+		return ExplanationFile{
+			Location: loc.Abbr,
+			File:     RelativeNamePath(ns.Folder, path),
+			Exists:   exists,
+			Bytes:    ns.FileLengths[sq.Type][loc.ID],
+			Entries:  ns.EntryCounts[sq.Type][loc.ID],
+		}
+	}
+
+	specific := ExplanationTier{Tier: ST_SPECIFIC.String(), Files: []ExplanationFile{file(sq.Location)}}
+
+	fallback := ExplanationTier{Tier: ST_FALLBACK.String(), Files: []ExplanationFile{}}
+	for _, relID := range sq.Location.RelatedIds {
+		if loc, ok := ns.Locations[relID]; ok {
+			fallback.Files = append(fallback.Files, file(loc))
+		}
+	}
+
+	// Extended searches every other name file of the entry type, wherever it is
+	extended := ExplanationTier{Tier: ST_EXTENDED.String(), Files: []ExplanationFile{}}
+	for _, loc := range ns.ExtendedLocations(sq.Location, sq.Type) {
+		extended.Files = append(extended.Files, file(loc))
+	}
+
+	ex.Tiers = []ExplanationTier{specific, fallback, extended}
+	return ex
+}
+
+// ExplainHandler shows how a query would be searched: the transliterations and replacements applied, matching could-bes, the final regular expression, and the files for each tier.
+func (s *Server) ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	ns := s.Names()
+	sq, errReason := s.NewSearchQuery(ns, params.Get("query"), params.Get("location"), params.Get("entry_type"))
+	if errReason != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError(errReason))
+		return
+	}
+
+	enc, err := json.Marshal(s.Explain(ns, sq))
+	if err != nil {
+		s.logger.DPanic("error encoding explanation", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(enc)
+}
@@ -1,40 +1,136 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"go.uber.org/zap"
 )
 
+// Counts are the number of entries that a search of each type would cover.
 type Counts struct {
 	Specific int64 `json:"specific"`
 	Fallback int64 `json:"fallback"` // sum of all fallback countries
 	Extended int64 `json:"extended"`
+
+	Bytes *Counts `json:"bytes,omitempty"` // the same figures, as file sizes
+}
+
+// ReadFileStats reads the file lengths and entry counts of every location in a names folder.
+func (s *Server) ReadFileStats(folder string, locations map[int]*Location) (map[EntryType]map[int]int64, map[EntryType]map[int]int64) {
+	fileLengths := make(map[EntryType]map[int]int64)
+	entryCounts := make(map[EntryType]map[int]int64)
+	for _, et := range ENTRY_TYPES {
+		fileLengths[et] = make(map[int]int64)
+		entryCounts[et] = make(map[int]int64)
+		for _, location := range locations {
+			fileLengths[et][location.ID], entryCounts[et][location.ID] = s.GetFileStats(folder, location, et)
+		}
+	}
+	return fileLengths, entryCounts
+}
+
+// SetFileStats sets the file lengths and entry counts of a NameState, and their totals.
+func (ns *NameState) SetFileStats(fileLengths, entryCounts map[EntryType]map[int]int64) {
+	ns.FileLengths = fileLengths
+	ns.TotalLengths = TotalLengths(fileLengths)
+	ns.EntryCounts = entryCounts
+	ns.TotalEntries = TotalLengths(entryCounts)
+}
+
+// UpdateFileLengths re-reads the file lengths and entry counts of only the given locations into ns, an unpublished copy.
+// The maps are copied rather than modified in place, as handlers may be reading the published ones.
+func (s *Server) UpdateFileLengths(ns *NameState, locs []*Location) {
+	fileLengths := make(map[EntryType]map[int]int64)
+	entryCounts := make(map[EntryType]map[int]int64)
+	for _, et := range ENTRY_TYPES {
+		fileLengths[et] = make(map[int]int64)
+		entryCounts[et] = make(map[int]int64)
+		for id, length := range ns.FileLengths[et] {
+			fileLengths[et][id] = length
+		}
+		for id, count := range ns.EntryCounts[et] {
+			entryCounts[et][id] = count
+		}
+		for _, location := range locs {
+			fileLengths[et][location.ID], entryCounts[et][location.ID] = s.GetFileStats(ns.Folder, location, et)
+		}
+	}
+
+	ns.SetFileStats(fileLengths, entryCounts)
+}
+
+// TotalLengths sums the figures of every location for each EntryType.
+func TotalLengths(fileLengths map[EntryType]map[int]int64) map[EntryType]int64 {
+	totalLengths := make(map[EntryType]int64)
+	for et, lengths := range fileLengths {
+		for _, length := range lengths {
+			totalLengths[et] += length
+		}
+	}
+	return totalLengths
+}
+
+// GetCounts returns the specific, fallback, and extended entry counts (and byte counts) for a location and type.
+func (ns *NameState) GetCounts(location *Location, et EntryType) Counts {
+	entries, lengths := ns.EntryCounts[et], ns.FileLengths[et]
+
+	c := Counts{
+		Specific: entries[location.ID],
+		Extended: ns.TotalEntries[et],
+		Bytes: &Counts{
+			Specific: lengths[location.ID],
+			Extended: ns.TotalLengths[et],
+		},
+	}
+	for _, relID := range location.RelatedIds {
+		c.Fallback += entries[relID]
+		c.Bytes.Fallback += lengths[relID]
+	}
+	return c
+}
+
+// LocationCounts are the Counts of every EntryType for a single location.
+type LocationCounts struct {
+	Abbr   string               `json:"abbr"`
+	Name   string               `json:"name"`
+	Counts map[EntryType]Counts `json:"counts"`
 }
 
-// InstallFileLengths sets up the arrays, grabs file lengths from the nameFolder, and populates the server's cache.
-//
-// Depends on InstallLocations.
-func (s *Server) InstallFileLengths() {
-	s.fileLengths = make(map[EntryType]map[int]int64)
-	s.totalLengths = make(map[EntryType]int64)
-	// Initialize main array
-	entryTypes := [3]EntryType{EntryType("N"), EntryType("P"), EntryType("O")}
+// GetAllCounts returns the LocationCounts of the given locations (or every location, if none are given), sorted by abbreviation.
+func (ns *NameState) GetAllCounts(locs []*Location) []LocationCounts {
+	if len(locs) == 0 {
+		for _, l := range ns.Locations {
+			locs = append(locs, l)
+		}
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		return locs[i].Abbr < locs[j].Abbr
+	})
 
-	for _, et := range entryTypes {
-		curTotal := int64(0)
-		s.fileLengths[et] = make(map[int]int64)
-		for _, location := range s.locations {
-			length := s.GetFileCharCount(location, et)
-			s.fileLengths[et][location.ID] = length
-			curTotal += length
+	all := []LocationCounts{}
+	for _, l := range locs {
+		lc := LocationCounts{Abbr: l.Abbr, Name: l.Name, Counts: make(map[EntryType]Counts)}
+		for _, et := range ENTRY_TYPES {
+			lc.Counts[et] = ns.GetCounts(l, et)
 		}
-		s.totalLengths[et] = curTotal
+		all = append(all, lc)
 	}
+	return all
 }
 
+// CountsETag returns the ETag for the counts, which changes whenever they are refreshed.
+func (ns *NameState) CountsETag() string {
+	return `"counts-` + strconv.FormatUint(ns.Generation, 10) + `"`
+}
+
+// MAX_LINE_LENGTH is the longest line that will be read from a name file.
+const MAX_LINE_LENGTH = 1024 * 1024
+
 // FileName takes a Location and Entrytype and returns the filename.
 func FileName(c *Location, et EntryType) string {
 	return strings.Title(strings.ToLower(c.Abbr)) + string(et) + ".txt"
@@ -46,18 +142,52 @@ func FileExists(fn string) bool {
 	return err == nil
 }
 
-// GetFileCharCount gets the length of a single file given the location and type.
-func (s *Server) GetFileCharCount(c *Location, t EntryType) int64 {
-	fileName := FileName(c, t)
-	folder := filepath.Join(NAME_FOLDER, c.Folder(), fileName)
-	if !FileExists(folder) {
+// GetFileCharCount gets the length (on disk, so compressed if the file is) of a single file given the names folder, location, and type.
+func (s *Server) GetFileCharCount(nameFolder string, c *Location, t EntryType) int64 {
+	folder, ok := NameFilePath(nameFolder, c, t)
+	if !ok {
 		return 0
 	}
 
 	fi, err := os.Stat(folder)
 	if err != nil {
 		s.logger.Error("error stat'ing file", zap.Error(err), zap.String(ZAP_PATH, folder))
+		return 0
 	}
 
 	return fi.Size()
 }
+
+// GetFileStats gets both the length and the number of entries of a single file given the names folder, location, and type.
+func (s *Server) GetFileStats(nameFolder string, c *Location, t EntryType) (int64, int64) {
+	length := s.GetFileCharCount(nameFolder, c, t)
+	if length == 0 {
+		return 0, 0
+	}
+
+	path, _ := NameFilePath(nameFolder, c, t)
+	entries, err := CountEntries(path)
+	if err != nil {
+		s.logger.Error("error counting entries", zap.Error(err), zap.String(ZAP_PATH, path))
+	}
+	return length, entries
+}
+
+// CountEntries returns the number of entries (non-blank lines) in a name file, decompressing it if needed.
+func CountEntries(path string) (int64, error) {
+	f, err := OpenNameFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LINE_LENGTH)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -34,17 +36,22 @@ func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) LocationsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write(s.cachedLocations)
+	w.Write(s.Names().CachedLocations)
 }
 
 func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
 	analytic := &SearchAnalytic{
-		UserId:        uuid.Nil,
-		Time:          startTime,
-		QueryLocation: pgtype.Int4{Status: pgtype.Null},
+		SearchId:       NewSearchId(),
+		UserId:         uuid.Nil,
+		Time:           startTime,
+		QueryLocation:  pgtype.Int4{Status: pgtype.Null},
+		FromSuggestion: pgtype.UUID{Status: pgtype.Null},
 	}
+	// So that a search made from a suggestion can refer back to this one
+	w.Header().Set("X-Search-Id", analytic.SearchId.String())
+	SetRequestDetail(r, analytic.SearchId.String()) // links the request to data_searches
 
 	defer func() {
 		analytic.Duration = int(time.Since(startTime).Milliseconds())
@@ -65,6 +72,7 @@ func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 		analytic.Error = "invalid_search_type"
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(MarshalError("invalid 'type' parameter provided. Should be one of 'specific', 'fallback', or 'extended'"))
+		return
 	}
 
 	analytic.Type = searchType
@@ -98,6 +106,11 @@ func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 		analytic.UserId = uuid.FromStringOrNil(userIds[0])
 	}
 
+	// The search whose suggestion was followed to make this one
+	if fromSuggestion := uuid.FromStringOrNil(params.Get("from_suggestion")); fromSuggestion != uuid.Nil {
+		analytic.FromSuggestion = pgtype.UUID{Bytes: fromSuggestion, Status: pgtype.Present}
+	}
+
 	numRequested := NUM_RESULTS
 	numRequesteds, ok := params["num"]
 	if ok && len(numRequesteds) > 0 {
@@ -109,7 +122,33 @@ func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	sq, errReason := s.NewSearchQuery(queries[0], locations[0], entryTypes[0])
+	format := params.Get("format")
+	if !IsResultFormat(format) {
+		analytic.Error = "invalid_format"
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid 'format' parameter provided. Should be one of 'json', 'jsonl', 'csv', or 'tsv'"))
+		return
+	}
+	if IsExportFormat(format) {
+		limit := MAX_EXPORT_RESULTS
+		if s.IsAuthorized(r) {
+			limit = MAX_EXPORT_RESULTS_AUTHORIZED
+		}
+		if numRequested > limit {
+			numRequested = limit
+		}
+	}
+
+	// By default, only the name column of files with attribute columns is searched
+	allColumns := params.Get("columns") == "all"
+
+	// Suggestions change the response to an object, so they're only available for RF_JSON
+	suggest, _ := strconv.ParseBool(params.Get("suggest"))
+	suggest = suggest && !IsExportFormat(format)
+
+	// The same names, locations, and file stats are used throughout, even if a version is activated meanwhile
+	ns := s.Names()
+	sq, errReason := s.NewSearchQuery(ns, queries[0], locations[0], entryTypes[0])
 	if errReason != "" {
 		analytic.Error = errReason
 		w.WriteHeader(http.StatusBadRequest)
@@ -120,129 +159,136 @@ func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	analytic.QueryLocation = pgtype.Int4{Int: int32(sq.Location.ID), Status: pgtype.Present}
 	analytic.QueryType = string(sq.Type)
 
-	sq.Query = s.FormatSearch(sq.Query)
+	formatted, variants, err := s.FormatSearch(sq.Query, sq.Location, sq.Type)
+	if err != nil {
+		s.logger.Info("error expanding macros", zap.Object(ZAP_SEARCH_QUERY, sq), zap.Error(err))
+		analytic.Error = "invalid_query"
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid query"))
+		return
+	}
+	sq.Query = formatted
 	analytic.QueryProcessed = sq.Query
 
-	entries := []Entry{}
+	// Results are streamed to the client as they're found. The ResultWriter is only created
+	// (and the headers sent) once the first entry is found, so that an invalid query can still be reported.
+	var rw ResultWriter
+	numReturned := 0
+	startResults := func() {
+		if rw == nil && suggest {
+			rw = NewSuggestingResultWriter(w, analytic.SearchId, func() *Suggestions {
+				analytic.Suggested = true
+				return s.Suggest(r.Context(), ns, analytic.QueryRaw, sq.Query, sq.Location, sq.Type)
+			})
+		} else if rw == nil {
+			rw = NewResultWriter(w, format, ns.AttributeNames(sq.Type), "search-"+sq.Location.Abbr+"-"+searchType.String())
+		}
+	}
+	writeEntry := func(e Entry) bool {
+		startResults()
+		e.Tier = searchType.String()
+		e.Variant = MatchVariant(variants, e)
+		analytic.AddVariant(e.Variant)
+		if err := rw.Write(e); err != nil {
+			s.logger.Error("error writing results", zap.Error(err))
+			return false
+		}
+		numReturned++
+		return true
+	}
+	flush := func() {
+		if rw != nil {
+			rw.Flush()
+		}
+	}
+	invalidQuery := func() {
+		analytic.Error = "invalid_query"
+		if rw != nil {
+			// Too late to tell the client
+			s.logger.Warn("invalid query after results were sent", zap.Object(ZAP_SEARCH_QUERY, sq))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid query"))
+	}
+
+	// Stops the search if the client goes away or it takes too long
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.SearchTimeout)
+	defer cancel()
 
 	switch searchType {
 	case ST_SPECIFIC:
-		curEntries, ok := s.IndividualSearch(sq.Query, sq.Location, sq.Type, numRequested)
+		_, ok := s.Measure(ctx, analytic.SearchId, searchType, sq.Location, func() (int, bool) {
+			return s.IndividualSearch(ctx, ns, sq.Query, sq.Location, sq.Type, numRequested, allColumns, writeEntry)
+		})
 		if !ok {
-			analytic.Error = "invalid_query"
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(MarshalError("invalid query"))
+			invalidQuery()
 			return
 		}
-		entries = curEntries
 	case ST_FALLBACK:
 		for _, relId := range sq.Location.RelatedIds {
-			if len(entries) >= numRequested {
+			if numReturned >= numRequested || ctx.Err() != nil {
 				break
 			}
-			curEntries, ok := s.IndividualSearch(sq.Query, s.locations[relId], sq.Type, numRequested-len(entries))
+			loc := ns.Locations[relId]
+			// Each location has its own scripts and replacements, so is searched with its own variants
+			query, locVariants, err := s.FormatSearch(analytic.QueryRaw, loc, sq.Type)
+			if err != nil {
+				invalidQuery()
+				break
+			}
+			variants = locVariants
+			writeFailed := false
+			_, ok := s.Measure(ctx, analytic.SearchId, searchType, loc, func() (int, bool) {
+				return s.IndividualSearch(ctx, ns, query, loc, sq.Type, numRequested-numReturned, allColumns, func(e Entry) bool {
+					writeFailed = !writeEntry(e)
+					return !writeFailed
+				})
+			})
 			if !ok {
-				analytic.Error = "invalid_query"
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write(MarshalError("invalid query"))
-				return
+				invalidQuery()
+				break
 			}
-			entries = append(entries, curEntries...)
+			if writeFailed {
+				break
+			}
+			flush()
 		}
 	case ST_EXTENDED:
-		curEntries, ok := s.ExtendedSearch(sq.Query, sq.Location, sq.Type, numRequested)
+		_, ok := s.Measure(ctx, analytic.SearchId, searchType, nil, func() (int, bool) {
+			return s.ExtendedSearch(ctx, ns, sq.Query, sq.Location, sq.Type, numRequested, allColumns, writeEntry)
+		})
 		if !ok {
-			analytic.Error = "invalid_query"
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(MarshalError("invalid query"))
+			invalidQuery()
+			return
+		}
+	}
+	flush()
+
+	analytic.NumReturned = numReturned
+	switch ctx.Err() {
+	case context.Canceled:
+		analytic.Error = "cancelled" // nobody to respond to
+		return
+	case context.DeadlineExceeded:
+		analytic.Error = "timeout"
+		if rw == nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write(MarshalError("search timed out"))
 			return
 		}
-		entries = curEntries
-	}
-
-	analytic.NumReturned = len(entries)
-	w.Write(MarshalEntries(entries))
-	/*
-	   	timeBeforeSpecificSearch := time.Now() // Start time
-	   	entries, ok := s.IndividualSearch(sq.Query, sq.Location, sq.Type, NUM_RESULTS, req.Logger)
-	   	specificSearchTime := time.Since(timeBeforeSpecificSearch) // End time
-	   	analytic.AddMeasurement(sq.Location.ID, len(entries), int(specificSearchTime.Milliseconds()))
-
-	   	if !ok {
-	   		// Invalid query?
-	   		analytic.IsValid = false
-	   		req.Write(MT_INVALID_QUERY, RS_INVALID_QUERY)
-	   		return
-	   	}
-
-	   	results := MarshalEntries(entries, s.logger)
-	   	if req.Conn.Canceled.Get() { // Check if canceled
-	   		analytic.Cancelled = "before-specific-results"
-	   		return
-	   	}
-	   	req.Write(MT_RESULTS, results)
-	   	numReturned += len(entries)
-
-	   	// Fallback
-	   	if (numReturned < NUM_RESULTS) && (len(sq.Location.RelatedIds) > 0) {
-	   		for _, curLocID := range sq.Location.RelatedIds {
-	   			if req.Conn.Canceled.Get() { // Check if canceled
-	   				analytic.Cancelled = "before-fallback-search"
-	   				return
-	   			}
-	   			s.logger.Info("fallback search", zap.Int("location_id", curLocID))
-	   			avoidExtended = append(avoidExtended, curLocID)
-
-	   			curLoc := s.locations[curLocID]
-	   			timeBeforeFallbackSearch := time.Now()
-	   			fallbackEntries, ok := s.IndividualSearch(sq.Query, curLoc, sq.Type, (NUM_RESULTS - numReturned), req.Logger)
-	   			analytic.AddMeasurement(curLocID, len(fallbackEntries), int(time.Since(timeBeforeFallbackSearch).Milliseconds()))
-	   			if !ok {
-	   				analytic.IsValid = false
-	   				req.Logger.Error("fallback search query not OK", zap.Object(ZAP_SEARCH_QUERY, sq))
-	   				req.Write(MT_INVALID_QUERY, RS_INVALID_QUERY)
-	   				return
-	   			}
-	   			results := MarshalEntries(fallbackEntries, s.logger)
-	   			if req.Conn.Canceled.Get() { // Check if canceled
-	   				analytic.Cancelled = "before-fallback-results"
-	   				return
-	   			}
-
-	   			req.Write(MT_FALLBACK_RESULTS, results)
-	   			numReturned += len(fallbackEntries)
-	   		}
-	   	}
-
-	   	// Extended
-	   	if numReturned < NUM_RESULTS {
-	   		if req.Conn.Canceled.Get() { // Check if canceled
-	   			analytic.Cancelled = "before-extended-search"
-	   			return
-	   		}
-
-	   		timeBeforeExtendedSearch := time.Now()
-	   		extendedEntries, ok := s.ExtendedSearch(sq.Query, sq.Type, (NUM_RESULTS - numReturned), avoidExtended, req.Logger)
-	   		extendedSearchTime := time.Since(timeBeforeExtendedSearch) // End time
-	   		analytic.AddMeasurement(-1, len(extendedEntries), int(extendedSearchTime.Milliseconds()))
-
-	   		if !ok {
-	   			analytic.IsValid = false
-	   			req.Logger.Error("extended search query not OK", zap.Object(ZAP_SEARCH_QUERY, sq))
-	   			req.Write(MT_INVALID_QUERY, RS_INVALID_QUERY)
-	   			return
-	   		} else {
-	   			extendedResults := MarshalEntries(extendedEntries, s.logger)
-	   			if req.Conn.Canceled.Get() { // Check if canceled
-	   				analytic.Cancelled = "before-extended-results"
-	   				return
-	   			}
-	   			req.Write(MT_EXTENDED_RESULTS, extendedResults)
-	   		}
-	   	}
-	   	analytic.IsFinished = true
-	   }
-	*/
+		// Finish the response, with whatever results were found in time
+		s.logger.Warn("search timed out after results were sent", zap.Object(ZAP_SEARCH_QUERY, sq))
+	}
+	if rw == nil {
+		if analytic.Error != "" {
+			return
+		}
+		startResults()
+	}
+	if err := rw.Close(); err != nil {
+		s.logger.Error("error finishing results", zap.Error(err))
+	}
 }
 
 func (s *Server) CountsHandler(w http.ResponseWriter, r *http.Request) {
@@ -261,34 +307,66 @@ func (s *Server) CountsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	location, ok := s.LookupLocationByAbbr(locations[0])
+	ns := s.Names()
+	location, ok := ns.LookupLocationByAbbr(locations[0])
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(MarshalError("invalid location"))
+		return
 	}
 
 	entryType, ok := NewEntryType(entryTypes[0])
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(MarshalError("invalid type"))
+		return
 	}
 
-	var fallbackCharacters int64
+	enc, err := json.Marshal(ns.GetCounts(location, entryType))
+	if err != nil {
+		s.logger.DPanic("error encoding counts", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+
+	w.Write(enc)
+}
 
-	for _, relID := range location.RelatedIds {
-		fallbackCharacters += s.fileLengths[entryType][relID]
+// CountsAllHandler returns the counts of every location and entry type at once.
+// An optional 'location' parameter (repeated or comma-separated) limits which locations are returned.
+func (s *Server) CountsAllHandler(w http.ResponseWriter, r *http.Request) {
+	ns := s.Names()
+	etag := ns.CountsETag()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
-	enc, err := json.Marshal(Counts{
-		Specific: s.fileLengths[entryType][location.ID],
-		Fallback: fallbackCharacters,
-		Extended: s.totalLengths[entryType],
-	})
+	locs := []*Location{}
+	for _, param := range r.URL.Query()["location"] {
+		for _, abbr := range strings.Split(param, ",") {
+			if abbr == "" {
+				continue
+			}
+			location, ok := ns.LookupLocationByAbbr(abbr)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(MarshalError("invalid location"))
+				return
+			}
+			locs = append(locs, location)
+		}
+	}
 
+	enc, err := json.Marshal(ns.GetAllCounts(locs))
 	if err != nil {
 		s.logger.DPanic("error encoding counts", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write(MarshalError("internal error"))
+		return
 	}
 
 	w.Write(enc)
@@ -308,15 +386,45 @@ func (s *Server) CouldBesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	query := queries[0]
 
-	cb := []CouldBe{}
+	// Optionally limited to the location and entry type being searched
+	var location *Location
+	if abbr := params.Get("location"); abbr != "" {
+		location, ok = s.Names().LookupLocationByAbbr(abbr)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError(RS_INVALID_LOCATION))
+			return
+		}
+	}
+	var entryType EntryType
+	if et := params.Get("entry_type"); et != "" {
+		entryType, ok = NewEntryType(et)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError(RS_INVALID_TYPE))
+			return
+		}
+	}
 
-	for k, v := range s.cachedCouldBes {
-		if strings.Contains(query, k) {
-			cb = append(cb, CouldBe{Key: k, Val: v})
+	couldBes := s.MatchCouldBes(query, location, entryType)
+	if category := params.Get("category"); category != "" {
+		filtered := []CouldBe{}
+		for _, cb := range couldBes {
+			if cb.Category == category {
+				filtered = append(filtered, cb)
+			}
 		}
+		couldBes = filtered
 	}
 
-	enc, err := json.Marshal(cb)
+	// Record which could-bes were shown
+	ids := []string{}
+	for _, cb := range couldBes {
+		ids = append(ids, strconv.Itoa(cb.ID))
+	}
+	SetRequestDetail(r, strings.Join(ids, ","))
+
+	enc, err := json.Marshal(couldBes)
 	if err != nil {
 		s.logger.DPanic("error marshaling couldbes", zap.Error(err))
 	}
@@ -327,4 +435,13 @@ func (s *Server) CouldBesHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) RefreshHandler(w http.ResponseWriter, r *http.Request) {
 	s.Refresh()
 	w.Write([]byte("Refreshed"))
+	for _, ir := range s.invalidReplacements {
+		fmt.Fprintf(w, "\ninvalid replacement %d (%q): %s", ir.ID, ir.Key, ir.Reason)
+	}
+	for _, ir := range s.invalidMacros {
+		fmt.Fprintf(w, "\ninvalid macro %d (%q): %s", ir.ID, ir.Key, ir.Reason)
+	}
+	for _, ir := range s.invalidCouldBes {
+		fmt.Fprintf(w, "\ninvalid could_be %d (%q): %s", ir.ID, ir.Key, ir.Reason)
+	}
 }
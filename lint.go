@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// Kinds of lint problems
+const (
+	LP_BAD_FOLDER_NAME   string = "bad_folder_name"
+	LP_BAD_FILE_NAME     string = "bad_file_name"
+	LP_INVALID_UTF8      string = "invalid_utf8"
+	LP_BOM               string = "bom"
+	LP_BLANK_LINE        string = "blank_line"
+	LP_TRAILING_SPACE    string = "trailing_whitespace"
+	LP_DUPLICATE         string = "duplicate"
+	LP_MIXED_LINE_ENDING string = "mixed_line_endings"
+	LP_UNREADABLE        string = "unreadable"
+	LP_DUPLICATE_FILE    string = "duplicate_file" // e.g. both AbN.txt and AbN.txt.gz
+)
+
+// MAX_LINT_PROBLEMS is the most problems listed for a single file. Every problem is still counted.
+const MAX_LINT_PROBLEMS int = 1000
+
+// LintProblem is a single problem found in a name file (or its name).
+type LintProblem struct {
+	Kind    string `json:"kind"`
+	Line    int    `json:"line,omitempty"` // 0 if the problem is with the whole file
+	Message string `json:"message"`
+}
+
+// LintReport is the result of linting a single file or folder.
+type LintReport struct {
+	Path     string         `json:"path"` // relative to the names folder
+	Problems []LintProblem  `json:"problems"`
+	Counts   map[string]int `json:"counts"`
+	Fixable  bool           `json:"fixable"`
+	Fixed    bool           `json:"fixed"`
+}
+
+func (lr *LintReport) add(kind string, line int, message string) {
+	if lr.Counts[kind] == 0 || len(lr.Problems) < MAX_LINT_PROBLEMS {
+		lr.Problems = append(lr.Problems, LintProblem{Kind: kind, Line: line, Message: message})
+	}
+	lr.Counts[kind]++
+}
+
+// needsFix returns whether the file has any problems that --fix would change.
+func (lr *LintReport) needsFix() bool {
+	for kind := range lr.Counts {
+		switch kind {
+		case LP_BOM, LP_BLANK_LINE, LP_TRAILING_SPACE, LP_DUPLICATE, LP_MIXED_LINE_ENDING:
+			return true
+		}
+	}
+	return false
+}
+
+func newLintReport(path string) LintReport {
+	return LintReport{Path: path, Problems: []LintProblem{}, Counts: make(map[string]int)}
+}
+
+// LintNameFolder checks every location folder and name file under root, optionally fixing what can be fixed safely.
+// attributes reports whether a location's name file of a type has attribute columns. Only reports with problems are returned.
+func LintNameFolder(root string, attributes func(loc *Location, et EntryType) bool, fix bool) ([]LintReport, error) {
+	reports := []LintReport{}
+
+	dirEntries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range dirEntries {
+		if !de.IsDir() || IsTempFile(de.Name()) {
+			continue
+		}
+
+		loc, ok := NewLocation(de.Name())
+		if !ok {
+			lr := newLintReport(de.Name())
+			lr.add(LP_BAD_FOLDER_NAME, 0, "folder name should be 'ABBR Name'")
+			reports = append(reports, lr)
+			continue
+		}
+
+		expected := make(map[string]EntryType)
+		for _, et := range ENTRY_TYPES {
+			for _, name := range NameFileNames(&loc, et) {
+				expected[name] = et
+			}
+		}
+		variants := make(map[EntryType]int)
+
+		files, err := os.ReadDir(filepath.Join(root, de.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || IsTempFile(f.Name()) {
+				continue
+			}
+			rel := filepath.Join(de.Name(), f.Name())
+
+			et, ok := expected[f.Name()]
+			lr := LintNameFile(filepath.Join(root, rel), !ok || attributes(&loc, et), fix)
+			lr.Path = rel
+			if !ok {
+				lr.add(LP_BAD_FILE_NAME, 0, fmt.Sprintf("file name should be one of %s, %s, or %s (optionally compressed)",
+					FileName(&loc, ENTRY_TYPES[0]), FileName(&loc, ENTRY_TYPES[1]), FileName(&loc, ENTRY_TYPES[2])))
+			} else if variants[et]++; variants[et] > 1 {
+				lr.add(LP_DUPLICATE_FILE, 0, "another (compressed or plain text) copy of "+FileName(&loc, et)+" exists, and only one will be searched")
+			}
+			if len(lr.Counts) > 0 {
+				reports = append(reports, lr)
+			}
+		}
+	}
+	return reports, nil
+}
+
+// LintNameFile checks the contents of a single name file. If fix is set and the file has no invalid UTF-8 (and isn't compressed),
+// it is rewritten without a BOM, blank lines, trailing whitespace, or duplicates, and with LF line endings.
+// With attributes, the file has attribute columns, so only the name column's trailing whitespace counts (see trimNameLine).
+func LintNameFile(path string, attributes bool, fix bool) LintReport {
+	lr := newLintReport(path)
+
+	duplicates, err := duplicateLines(path, attributes)
+	if err != nil {
+		lr.add(LP_UNREADABLE, 0, err.Error())
+		return lr
+	}
+
+	f, err := OpenNameFile(path)
+	if err != nil {
+		lr.add(LP_UNREADABLE, 0, err.Error())
+		return lr
+	}
+	defer f.Close()
+
+	lineEnding := ""
+	err = ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+		if lineNum == 1 && bytes.HasPrefix(content, UTF8_BOM) {
+			lr.add(LP_BOM, lineNum, "file starts with a byte order mark")
+			content = content[len(UTF8_BOM):]
+		}
+		if !utf8.Valid(content) {
+			lr.add(LP_INVALID_UTF8, lineNum, "line is not valid UTF-8")
+		}
+		if ending != "" {
+			if lineEnding == "" {
+				lineEnding = ending
+			} else if ending != lineEnding && lr.Counts[LP_MIXED_LINE_ENDING] == 0 {
+				lr.add(LP_MIXED_LINE_ENDING, lineNum, "line ending differs from earlier lines")
+			}
+		}
+
+		if len(bytes.TrimSpace(content)) == 0 {
+			lr.add(LP_BLANK_LINE, lineNum, "blank line")
+			return true
+		}
+		if len(trimNameLine(content, attributes)) != len(content) {
+			lr.add(LP_TRAILING_SPACE, lineNum, "trailing whitespace")
+		}
+
+		if first, ok := duplicates[lineNum]; ok {
+			lr.add(LP_DUPLICATE, lineNum, "duplicate of line "+strconv.Itoa(first))
+		}
+		return true
+	})
+	if err != nil {
+		lr.add(LP_UNREADABLE, 0, err.Error())
+		return lr
+	}
+
+	lr.Fixable = lr.Counts[LP_INVALID_UTF8] == 0 && !IsCompressed(path)
+	if fix && lr.Fixable && lr.needsFix() {
+		if err := FixNameFile(path, attributes); err != nil {
+			lr.add(LP_UNREADABLE, 0, "error fixing: "+err.Error())
+		} else {
+			lr.Fixed = true
+		}
+	}
+	return lr
+}
+
+// FixNameFile normalizes a name file in place (atomically). See LintNameFile.
+func FixNameFile(path string, attributes bool) error {
+	duplicates, err := duplicateLines(path, attributes)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		err := ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+			normalized := normalizeNameLine(lineNum, content, attributes)
+			if normalized == nil {
+				return true
+			}
+			if _, ok := duplicates[lineNum]; ok {
+				return true
+			}
+
+			bw.Write(normalized)
+			bw.WriteByte('\n')
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
+
+// trimNameLine removes trailing whitespace from a line of a name file. With attributes, trailing tabs are empty attribute
+// columns rather than whitespace, so only the name column is trimmed.
+func trimNameLine(content []byte, attributes bool) []byte {
+	i := bytes.IndexByte(content, '\t')
+	if !attributes || i == -1 {
+		return bytes.TrimRightFunc(content, unicode.IsSpace)
+	}
+	name := bytes.TrimRightFunc(content[:i], unicode.IsSpace)
+	if len(name) == i {
+		return content
+	}
+	return append(append([]byte{}, name...), content[i:]...)
+}
+
+// normalizeNameLine returns a line of a name file as FixNameFile writes it, or nil if the line is blank and dropped.
+func normalizeNameLine(lineNum int, content []byte, attributes bool) []byte {
+	if lineNum == 1 {
+		content = bytes.TrimPrefix(content, UTF8_BOM)
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil
+	}
+	return trimNameLine(content, attributes)
+}
+
+// duplicateLines finds the lines of a name file that repeat an earlier line (once normalized), returning the first line
+// each one repeats. Name files can be too big to keep every line in memory, so only a hash of each is kept, and lines whose
+// hash was already seen are compared with the earlier lines in a second pass.
+func duplicateLines(path string, attributes bool) (map[int]int, error) {
+	hashLine := func(line []byte) uint64 {
+		h := fnv.New64a()
+		h.Write(line)
+		return h.Sum64()
+	}
+
+	f, err := OpenNameFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint64]int)    // hash -> first line with it
+	candidates := make(map[int]int) // line -> first line with the same hash
+	err = ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+		normalized := normalizeNameLine(lineNum, content, attributes)
+		if normalized == nil {
+			return true
+		}
+		hash := hashLine(normalized)
+		if first, ok := seen[hash]; ok {
+			candidates[lineNum] = first
+		} else {
+			seen[hash] = lineNum
+		}
+		return true
+	})
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make(map[int]int)
+	if len(candidates) == 0 {
+		return duplicates, nil
+	}
+	seen = nil
+
+	// The distinct lines with each hash, by the first line with it
+	type distinctLine struct {
+		lineNum int
+		content string
+	}
+	distinct := make(map[int][]distinctLine)
+	for _, first := range candidates {
+		distinct[first] = nil
+	}
+
+	f, err = OpenNameFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+		if _, ok := distinct[lineNum]; ok {
+			distinct[lineNum] = []distinctLine{{lineNum, string(normalizeNameLine(lineNum, content, attributes))}}
+			return true
+		}
+		first, ok := candidates[lineNum]
+		if !ok {
+			return true
+		}
+		normalized := string(normalizeNameLine(lineNum, content, attributes))
+		for _, dl := range distinct[first] {
+			if dl.content == normalized {
+				duplicates[lineNum] = dl.lineNum
+				return true
+			}
+		}
+		distinct[first] = append(distinct[first], distinctLine{lineNum, normalized})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// ScanNameLines calls fn with the content and line ending of every line of a name file, stopping early if fn returns false.
+func ScanNameLines(r io.Reader, fn func(lineNum int, content []byte, ending string) bool) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			content, ending := SplitLineEnding(line)
+			if !fn(lineNum, content, ending) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// RunLint is the 'lint' subcommand. It returns the exit code: 1 if any problems remain, 2 on error.
+func RunLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "normalize files that can be fixed safely")
+	asJson := flags.Bool("json", false, "print the reports as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var root string
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	} else {
+		active, err := ActiveNameFolder()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error finding active names folder:", err)
+			return 2
+		}
+		root = active
+	}
+
+	// Without the database, which attribute columns a location has is unknown, so trailing tabs are always kept
+	reports, err := LintNameFolder(root, func(loc *Location, et EntryType) bool { return true }, *fix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error linting:", err)
+		return 2
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+	} else {
+		for _, lr := range reports {
+			for _, p := range lr.Problems {
+				if p.Line > 0 {
+					fmt.Printf("%s:%d: %s: %s\n", lr.Path, p.Line, p.Kind, p.Message)
+				} else {
+					fmt.Printf("%s: %s: %s\n", lr.Path, p.Kind, p.Message)
+				}
+			}
+			if lr.Fixed {
+				fmt.Printf("%s: fixed\n", lr.Path)
+			}
+		}
+	}
+
+	for _, lr := range reports {
+		if !lr.Fixed {
+			return 1
+		}
+	}
+	return 0
+}
+
+// LintHandler lints the names folder, fixing files if 'fix=true' is given (with POST), and returns the reports.
+func (s *Server) LintHandler(w http.ResponseWriter, r *http.Request) {
+	fix, _ := strconv.ParseBool(r.URL.Query().Get("fix"))
+	if fix && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(MarshalError("fix with POST"))
+		return
+	}
+
+	ns := s.Names()
+	reports, err := LintNameFolder(ns.Folder, func(loc *Location, et EntryType) bool {
+		if l, ok := ns.LookupLocationByAbbr(loc.Abbr); ok {
+			return l.HasAttributes(et)
+		}
+		return true
+	}, fix)
+	if err != nil {
+		s.logger.Error("error linting names folder", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+
+	fixed := make(map[string]bool)
+	for _, lr := range reports {
+		if lr.Fixed {
+			fixed[lr.Path] = true
+		}
+	}
+	if len(fixed) > 0 {
+		s.logger.Info("fixed name files", zap.Int("num", len(fixed)))
+		s.RefreshPaths(fixed)
+	}
+
+	enc, err := json.Marshal(reports)
+	if err != nil {
+		s.logger.DPanic("error encoding lint reports", zap.Error(err))
+	}
+	w.Write(enc)
+}
@@ -13,6 +13,14 @@ type Location struct {
 	Name       string `json:"name"`
 	IsLanguage bool   `json:"-"`
 	RelatedIds []int  `json:"-"`
+
+	// Attributes are the names of the extra tab-separated columns in each name file, after the name itself.
+	Attributes map[EntryType][]string `json:"-"`
+
+	// Scripts are the scripts the location's names are written in; Latin if empty.
+	// Queries are transliterated into each of them, using the location's Transliterations.
+	Scripts          []Script                    `json:"scripts,omitempty"`
+	Transliterations map[Script]*Transliteration `json:"-"`
 }
 
 /*
@@ -29,6 +37,46 @@ func (c Location) Folder() string {
 	return c.Abbr + " " + c.Name
 }
 
+// HasAttributes returns whether the name file of the given type has extra columns.
+func (c Location) HasAttributes(et EntryType) bool {
+	return len(c.Attributes[et]) > 0
+}
+
+// AllScripts returns the scripts the location's names are written in.
+func (c Location) AllScripts() []Script {
+	if len(c.Scripts) == 0 {
+		return []Script{SC_LATIN}
+	}
+	return c.Scripts
+}
+
+// NewEntry creates an Entry from a line of this location's name file, splitting off any attribute columns.
+// path (relative to the names folder) and lineNum record where the line came from.
+func (c *Location) NewEntry(line string, et EntryType, path string, lineNum int) Entry {
+	line = strings.TrimSuffix(line, "\r")
+	e := Entry{
+		ID:       EntryID(c, et, line),
+		Name:     line,
+		Type:     et,
+		Location: c,
+		File:     path,
+		Line:     lineNum,
+	}
+	if !c.HasAttributes(et) {
+		return e
+	}
+
+	columns := strings.Split(line, "\t")
+	e.Name = columns[0]
+	e.Attributes = make(map[string]string)
+	for i, attr := range c.Attributes[et] {
+		if i+1 < len(columns) {
+			e.Attributes[attr] = columns[i+1]
+		}
+	}
+	return e
+}
+
 // NewLocation creates a location from a folder name
 func NewLocation(dir string) (Location, bool) {
 	parts := strings.SplitN(dir, " ", 2) // ABBR NAME
@@ -2,18 +2,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"os"
-	"sort"
 
+	"github.com/jackc/pgtype"
 	"go.uber.org/zap"
 )
 
-// InstallLocations grabs the list of locations from the nameFolder and populates the server's cache.
-func (s *Server) InstallLocations() {
-	dirEntries, err := os.ReadDir(NAME_FOLDER)
+// LoadLocations reads the locations in a names folder, adding any new ones to the database,
+// and returns them along with their related locations and attributes.
+func (s *Server) LoadLocations(folder string) (map[int]*Location, error) {
+	dirEntries, err := os.ReadDir(folder)
 	if err != nil {
-		s.logger.Panic(err.Error())
+		return nil, err
 	}
 	d := []Location{}
 	for _, de := range dirEntries {
@@ -31,33 +31,42 @@ func (s *Server) InstallLocations() {
 	}
 
 	numUpdated := 0
-	s.locations = make(map[int]*Location)
+	locations := make(map[int]*Location)
 
-	rows, _ := s.conn.Query(context.Background(), "SELECT id, abbr, name, is_language FROM locations")
+	rows, _ := s.conn.Query(context.Background(), "SELECT id, abbr, name, is_language, COALESCE(scripts, '') FROM locations")
 	// Go through rows we already have
 	for rows.Next() {
 		var id int
-		var abbr, name string
+		var abbr, name, scripts string
 		var is_language bool
 
-		err = rows.Scan(&id, &abbr, &name, &is_language)
+		err = rows.Scan(&id, &abbr, &name, &is_language, &scripts)
 		if err != nil {
 			s.logger.Error("error reading location", zap.Error(err))
 			continue
 		}
 
-		s.locations[id] = &Location{
+		loc := &Location{
 			ID:         id,
 			Abbr:       abbr,
 			Name:       name,
 			IsLanguage: is_language,
 		}
+		for _, script := range SplitList(scripts) {
+			sc, ok := NewScript(script)
+			if !ok {
+				s.logger.Warn("unknown script", zap.String("abbr", abbr), zap.String("script", script))
+				continue
+			}
+			loc.Scripts = append(loc.Scripts, sc)
+		}
+		locations[id] = loc
 	}
 
 	// And now check to make sure we aren't missing any
 	for _, curFSLocation := range d {
 		ok := false
-		for _, curDBLocation := range s.locations {
+		for _, curDBLocation := range locations {
 			if curFSLocation.Abbr == curDBLocation.Abbr {
 				ok = true
 				break
@@ -77,7 +86,7 @@ func (s *Server) InstallLocations() {
 			continue
 		}
 		numUpdated++
-		s.locations[id] = &Location{
+		locations[id] = &Location{
 			ID:         id,
 			Abbr:       curFSLocation.Abbr,
 			Name:       curFSLocation.Name,
@@ -96,38 +105,39 @@ func (s *Server) InstallLocations() {
 			continue
 		}
 
-		s.locations[locationID].RelatedIds = append(s.locations[locationID].RelatedIds, relatedID)
+		if loc, ok := locations[locationID]; ok {
+			loc.RelatedIds = append(loc.RelatedIds, relatedID)
+		}
 		// s.logger.Info("adding related connection", zap.Int("location_id", locationID), zap.Int("related_id", relatedID))
 	}
 
-	s.logger.Info("updated locations", zap.Int("num_updated", numUpdated))
-	s.CacheLocations()
-}
-
-func (s *Server) CacheLocations() {
-	var loc []*Location
+	rows, _ = s.conn.Query(context.Background(), "SELECT location_id, entry_type, name FROM location_attributes ORDER BY location_id, sort, id")
+	for rows.Next() {
+		var locationID int
+		var entryType pgtype.BPChar
+		var name string
+		err := rows.Scan(&locationID, &entryType, &name)
+		if err != nil {
+			s.logger.Error("error reading location_attributes", zap.Error(err))
+			continue
+		}
 
-	for _, l := range s.locations {
-		loc = append(loc, l)
+		loc, ok := locations[locationID]
+		if !ok {
+			continue
+		}
+		if loc.Attributes == nil {
+			loc.Attributes = make(map[EntryType][]string)
+		}
+		for _, et := range ENTRY_TYPES {
+			if entryType.Status != pgtype.Present || EntryType(entryType.String) == et {
+				loc.Attributes[et] = append(loc.Attributes[et], name)
+			}
+		}
 	}
 
-	sort.Slice(loc, func(i, j int) bool {
-		return loc[i].Abbr < loc[j].Abbr
-	})
-	enc, err := json.Marshal(loc)
-	if err != nil {
-		s.logger.DPanic("error marshaling locations", zap.Error(err))
-		return
-	}
-	s.cachedLocations = enc
-}
+	s.loadTransliterations(locations)
 
-// LookupLocationByAbbr takes a locationAbbr and returns the associated Location.
-func (s *Server) LookupLocationByAbbr(locationAbbr string) (*Location, bool) {
-	for _, e := range s.locations {
-		if e.Abbr == locationAbbr {
-			return e, true
-		}
-	}
-	return &Location{}, false
+	s.logger.Info("updated locations", zap.Int("num_updated", numUpdated))
+	return locations, nil
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// MAX_MACRO_DEPTH is how deeply macros can refer to other macros.
+	MAX_MACRO_DEPTH int = 8
+	// MAX_MACRO_LENGTH is the longest a query can get by expanding macros, in bytes.
+	MAX_MACRO_LENGTH int = 64 << 10
+
+	// MACRO_PLACEHOLDER is the first of the private use characters that hold the place of macros in a query, see HoldMacros.
+	MACRO_PLACEHOLDER rune = '\uE000'
+	// MAX_QUERY_MACROS is how many macros a query can use, one for each private use character.
+	MAX_QUERY_MACROS int = 0xF8FF - 0xE000 + 1
+)
+
+// MACRO_NAME is the form of a macro's name. It must start with a letter, so "{2}" is still a repetition.
+var MACRO_NAME = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+var (
+	ErrMacroDepth  = errors.New("macros nested too deeply")
+	ErrMacroLength = errors.New("expanded query too long")
+	ErrMacroCount  = errors.New("too many macros in query")
+)
+
+// Macro is a named regular expression fragment. Writing {Name} in a query is the same as writing (?:Val).
+// Macros can use other macros.
+type Macro struct {
+	ID          int    `json:"-"`
+	Name        string `json:"name"`
+	Val         string `json:"val"`
+	Description string `json:"description,omitempty"`
+}
+
+// HeldMacro is a macro used in a query, whose place is held by a placeholder character. See HoldMacros.
+type HeldMacro struct {
+	Name     string
+	Expanded string // its value, with any macros it uses expanded
+}
+
+// HeldMacros are the macros of a query, in the order of their placeholders.
+type HeldMacros []HeldMacro
+
+// HoldMacros replaces every {Name} in a query with a placeholder character. Unknown names, escaped braces, and braces in
+// character classes are left alone. The query can then be changed (by replacements) without changing its macros, which
+// are put back with Release.
+func HoldMacros(q string, macros map[string]Macro) (string, HeldMacros, error) {
+	held := HeldMacros{}
+	q, err := expandMacros(q, macros, 0, false, &held)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(held.Release(q)) > MAX_MACRO_LENGTH {
+		return "", nil, ErrMacroLength
+	}
+	return q, held, nil
+}
+
+// Release replaces the placeholders in q with their macros' expansions, as (?:Expanded).
+func (hm HeldMacros) Release(q string) string {
+	return hm.replace(q, func(m HeldMacro) string {
+		return "(?:" + m.Expanded + ")"
+	})
+}
+
+// Show replaces the placeholders in q with their macros' names, as {Name}, to show the query as it was written.
+func (hm HeldMacros) Show(q string) string {
+	return hm.replace(q, func(m HeldMacro) string {
+		return "{" + m.Name + "}"
+	})
+}
+
+func (hm HeldMacros) replace(q string, fn func(m HeldMacro) string) string {
+	if len(hm) == 0 {
+		return q
+	}
+	var b strings.Builder
+	for _, r := range q {
+		if i := int(r - MACRO_PLACEHOLDER); i >= 0 && i < len(hm) {
+			b.WriteString(fn(hm[i]))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// expandMacros replaces every {Name} in a query with its macro, or if held isn't nil, only the outermost ones with
+// placeholders (see HoldMacros). If strict is set, a name that could be a macro but isn't is an error.
+func expandMacros(q string, macros map[string]Macro, depth int, strict bool, held *HeldMacros) (string, error) {
+	if depth > MAX_MACRO_DEPTH {
+		return "", ErrMacroDepth
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(q); {
+		if b.Len() > MAX_MACRO_LENGTH {
+			return "", ErrMacroLength
+		}
+
+		switch q[i] {
+		case '\\':
+			end := i + 2
+			if end > len(q) {
+				end = len(q)
+			}
+			b.WriteString(q[i:end])
+			i = end
+		case '[':
+			end := ClassEnd(q, i)
+			b.WriteString(q[i:end])
+			i = end
+		case '{':
+			j := strings.IndexByte(q[i:], '}')
+			if j < 0 {
+				b.WriteString(q[i:])
+				i = len(q)
+				continue
+			}
+			name := q[i+1 : i+j]
+			m, ok := macros[name]
+			if !ok {
+				if strict && MACRO_NAME.MatchString(name) {
+					return "", fmt.Errorf("unknown macro {%s}", name)
+				}
+				b.WriteByte('{')
+				i++
+				continue
+			}
+			expanded, err := expandMacros(m.Val, macros, depth+1, strict, nil)
+			if err != nil {
+				return "", err
+			}
+			if held != nil {
+				if len(*held) == MAX_QUERY_MACROS {
+					return "", ErrMacroCount
+				}
+				b.WriteRune(MACRO_PLACEHOLDER + rune(len(*held)))
+				*held = append(*held, HeldMacro{Name: name, Expanded: expanded})
+			} else {
+				b.WriteString("(?:" + expanded + ")")
+			}
+			i += j + 1
+		default:
+			b.WriteByte(q[i])
+			i++
+		}
+	}
+	if b.Len() > MAX_MACRO_LENGTH {
+		return "", ErrMacroLength
+	}
+	return b.String(), nil
+}
+
+// ClassEnd returns the index just after the character class starting at q[i], which is '['.
+func ClassEnd(q string, i int) int {
+	j := i + 1
+	if strings.HasPrefix(q[j:], "^") {
+		j++
+	}
+	if strings.HasPrefix(q[j:], "]") {
+		j++ // a literal ']'
+	}
+	for j < len(q) && q[j] != ']' {
+		switch {
+		case q[j] == '\\':
+			j++
+		case strings.HasPrefix(q[j:], "[:"):
+			if k := strings.Index(q[j:], ":]"); k >= 0 {
+				j += k + 1
+			}
+		}
+		j++
+	}
+	if j < len(q) {
+		j++
+	}
+	return j
+}
+
+// InstallMacros retrieves all macros from the database, validates them, and populates the server's cache.
+// Invalid macros, and any macros using them, are logged and skipped.
+func (s *Server) InstallMacros() {
+	macros := make(map[string]Macro)
+	invalid := []InvalidRule{}
+
+	rows, _ := s.conn.Query(context.Background(), "SELECT id, name, val, COALESCE(description, '') FROM macros ORDER BY id")
+	defer rows.Close()
+	for rows.Next() {
+		var m Macro
+		err := rows.Scan(&m.ID, &m.Name, &m.Val, &m.Description)
+		if err != nil {
+			s.logger.DPanic("error getting macro", zap.Error(err))
+			continue
+		}
+
+		switch {
+		case !MACRO_NAME.MatchString(m.Name):
+			err = fmt.Errorf("invalid name, should be a letter followed by letters, digits, or underscores")
+		case m.Val == "":
+			err = errors.New("blank val")
+		}
+		if _, ok := macros[m.Name]; ok && err == nil {
+			err = errors.New("duplicate name")
+		}
+		if err != nil {
+			invalid = append(invalid, InvalidRule{ID: m.ID, Key: m.Name, Reason: err.Error()})
+			continue
+		}
+		macros[m.Name] = m
+	}
+
+	// Removing a macro can make the ones using it invalid, so repeat until nothing changes
+	for changed := true; changed; {
+		changed = false
+		for name, m := range macros {
+			expanded, err := expandMacros("{"+name+"}", macros, 0, true, nil)
+			if err == nil {
+				_, err = CompileQuery(expanded) // a macro using itself fails with ErrMacroDepth
+			}
+			if err != nil {
+				invalid = append(invalid, InvalidRule{ID: m.ID, Key: m.Name, Reason: err.Error()})
+				delete(macros, name)
+				changed = true
+			}
+		}
+	}
+
+	for _, ir := range invalid {
+		s.logger.Error("invalid macro", zap.Int("id", ir.ID), zap.String("name", ir.Key), zap.String("reason", ir.Reason))
+	}
+	sort.Slice(invalid, func(i, j int) bool { return invalid[i].ID < invalid[j].ID })
+
+	s.cachedMacros = macros
+	s.invalidMacros = invalid
+	s.logger.Info("macros", zap.Int("num", len(macros)), zap.Int("invalid", len(invalid)))
+}
+
+// MacrosHandler lists the macros, sorted by name.
+func (s *Server) MacrosHandler(w http.ResponseWriter, r *http.Request) {
+	macros := []Macro{}
+	for _, m := range s.cachedMacros {
+		macros = append(macros, m)
+	}
+	sort.Slice(macros, func(i, j int) bool { return macros[i].Name < macros[j].Name })
+
+	enc, err := json.Marshal(macros)
+	if err != nil {
+		s.logger.DPanic("error encoding macros", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(enc)
+}
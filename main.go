@@ -13,13 +13,27 @@ func main() {
 
 	godotenv.Load()
 
+	// Subcommands, which don't need the HTTP server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lint":
+			os.Exit(RunLint(os.Args[2:]))
+		case "diff":
+			os.Exit(RunDiff(os.Args[2:]))
+		case "mine":
+			os.Exit(RunMine(logger, os.Args[2:]))
+		default:
+			logger.Fatal("unknown subcommand", zap.String("subcommand", os.Args[1]))
+		}
+	}
+
 	// Environmental variables
-	dbString := os.Getenv("DB_STRING")
-	if dbString == "" {
+	config := LoadConfig(logger)
+	if config.DBString == "" {
 		logger.Fatal("no DB_STRING provided")
 	}
 
-	s := NewServer(dbString, logger)
+	s := NewServer(config, logger)
 
 	s.Run()
 }
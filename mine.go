@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
+)
+
+// Kinds of rule proposed by mining
+const (
+	MP_REPLACEMENT string = "replacement"
+	MP_COULD_BE    string = "could_be"
+)
+
+const (
+	// MAX_MINING_DIFF is the longest difference (in letters) between a query and a name that is proposed as a replacement.
+	// Longer differences are proposed as could-bes of the whole query.
+	MAX_MINING_DIFF int = 3
+	// MIN_MINING_QUERIES is how many different queries must share a difference for it to be proposed as a replacement.
+	MIN_MINING_QUERIES int = 2
+	// MAX_MINING_EXAMPLES is the most examples kept as evidence for each proposal.
+	MAX_MINING_EXAMPLES int = 10
+	// MINING_TIMEOUT is how long mining can take.
+	MINING_TIMEOUT = 10 * time.Minute
+)
+
+// RuleProposal is a replacement or could-be that would have helped searches that had no results, for a curator to approve.
+type RuleProposal struct {
+	Kind string `json:"kind"` // MP_REPLACEMENT or MP_COULD_BE
+	Key  string `json:"key"`
+	Val  string `json:"val"`
+	Scope
+	Evidence MiningEvidence `json:"evidence"`
+}
+
+// MiningEvidence is why a rule was proposed.
+type MiningEvidence struct {
+	Searches int64           `json:"searches"` // zero-result searches it would have helped
+	Queries  int             `json:"queries"`  // distinct queries it would have helped
+	Examples []MiningExample `json:"examples"` // the most searched ones
+}
+
+// MiningExample is a zero-result query, and the names it was close to.
+type MiningExample struct {
+	Query     string           `json:"query"`
+	Location  string           `json:"location"` // abbreviation
+	EntryType EntryType        `json:"entry_type"`
+	Searches  int64            `json:"searches"`
+	Names     []NameSuggestion `json:"names"`
+}
+
+// MiningReport is the result of mining zero-result searches.
+type MiningReport struct {
+	Filter    ReportFilter   `json:"filter"`
+	Mined     int            `json:"mined"`     // distinct queries looked at
+	Truncated bool           `json:"truncated"` // mining ran out of time, so not every query was looked at
+	Proposals []RuleProposal `json:"proposals"`
+}
+
+// zeroResultQuery is a query that had no results, and how often it was searched.
+type zeroResultQuery struct {
+	query    string
+	loc      *Location
+	et       EntryType
+	searches int64
+}
+
+// zeroResultQueries returns the most searched queries that had no results, most searched first.
+// Anonymized searches are skipped, since their queries are hashed or truncated.
+func (s *Server) zeroResultQueries(ctx context.Context, ns *NameState, f ReportFilter) ([]zeroResultQuery, error) {
+	where, args := f.Where("COALESCE(d.error, '') = ''", "d.num_returned = 0", "NOT d.anonymized", "d.query_location IS NOT NULL")
+	args = append(args, f.Limit)
+	rows, err := s.conn.Query(ctx, `SELECT d.query_raw, d.query_location, d.query_type, COUNT(*)
+		FROM data_searches d `+where+`
+		GROUP BY d.query_raw, d.query_location, d.query_type
+		ORDER BY COUNT(*) DESC, d.query_raw LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := []zeroResultQuery{}
+	for rows.Next() {
+		var q zeroResultQuery
+		var query, et pgtype.Text
+		var locID int
+		if err := rows.Scan(&query, &locID, &et, &q.searches); err != nil {
+			return nil, err
+		}
+		loc, ok := ns.Locations[locID]
+		if !ok || query.String == "" {
+			continue
+		}
+		q.query, q.loc, q.et = query.String, loc, EntryType(strings.TrimSpace(et.String))
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// MineDiff returns the part of query that differs from name, and what it is in name.
+// If one is empty (a letter was added or left out), both are widened by a neighbouring letter, so neither is.
+func MineDiff(query, name []rune) (string, string) {
+	p := 0
+	for p < len(query) && p < len(name) && query[p] == name[p] {
+		p++
+	}
+	sfx := 0
+	for sfx < len(query)-p && sfx < len(name)-p && query[len(query)-1-sfx] == name[len(name)-1-sfx] {
+		sfx++
+	}
+	from, to := query[p:len(query)-sfx], name[p:len(name)-sfx]
+	if len(from) == 0 && len(to) == 0 {
+		return "", "" // the same
+	}
+	if len(from) == 0 || len(to) == 0 {
+		if p > 0 {
+			from, to = query[p-1:len(query)-sfx], name[p-1:len(name)-sfx]
+		} else if sfx > 0 {
+			from, to = query[p:len(query)-sfx+1], name[p:len(name)-sfx+1]
+		}
+	}
+	return string(from), string(to)
+}
+
+// closestWord returns whichever of a name and its words is closest to lit.
+func closestWord(lit []rune, name string) []rune {
+	lower := strings.ToLower(name)
+	best, bestDistance := []rune(lower), EditDistance(lit, []rune(lower), len(lit)+len(lower))
+	for _, w := range strings.Fields(lower) {
+		if d := EditDistance(lit, []rune(w), len(lit)+len(w)); d < bestDistance {
+			best, bestDistance = []rune(w), d
+		}
+	}
+	return best
+}
+
+// proposalCluster collects the examples of one proposal.
+type proposalCluster struct {
+	RuleProposal
+	queries map[string]bool
+}
+
+func (c *proposalCluster) add(ex MiningExample) {
+	c.Evidence.Searches += ex.Searches
+	if !c.queries[ex.Query] {
+		c.queries[ex.Query] = true
+		c.Evidence.Queries++
+		if len(c.Evidence.Examples) < MAX_MINING_EXAMPLES {
+			c.Evidence.Examples = append(c.Evidence.Examples, ex)
+		}
+	}
+}
+
+// scope limits the proposal to the location and entry type of its examples, if they all have the same one.
+func (c *proposalCluster) scope() Scope {
+	sc := Scope{}
+	locs, ets := make(map[string]bool), make(map[EntryType]bool)
+	for _, ex := range c.Evidence.Examples {
+		locs[ex.Location] = true
+		ets[ex.EntryType] = true
+	}
+	if len(locs) == 1 {
+		sc.Locations = []string{c.Evidence.Examples[0].Location}
+	}
+	if len(ets) == 1 {
+		sc.EntryTypes = []EntryType{c.Evidence.Examples[0].EntryType}
+	}
+	return sc
+}
+
+// mineFile reads a name file once for all of its zero-result queries, returning the names closest to each query that
+// still has no results, or none for the rest. It returns false if ctx is done before the whole file is read.
+func (s *Server) mineFile(ctx context.Context, ns *NameState, loc *Location, et EntryType, queries []zeroResultQuery) ([][]NameSuggestion, bool) {
+	names := make([][]NameSuggestion, len(queries))
+	res := make([]*regexp.Regexp, len(queries))
+	suggesters := make([]*nameSuggester, len(queries))
+	pending := 0
+	for i, q := range queries {
+		formatted, _, err := s.FormatSearch(q.query, loc, et)
+		if err != nil {
+			continue // invalid
+		}
+		if res[i], err = CompileQuery(formatted); err != nil {
+			continue
+		}
+		if suggesters[i] = newNameSuggester(q.query); suggesters[i] != nil {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return names, true
+	}
+
+	path, ok := suggestFilePath(ns, loc, et)
+	if !ok {
+		return names, true
+	}
+	f, err := OpenNameFile(path)
+	if err != nil {
+		s.logger.Error("error opening name file", zap.Error(err), zap.String(ZAP_PATH, path))
+		return names, true
+	}
+	defer f.Close()
+
+	lr := limitSuggestFile(f)
+	err = ScanNameLines(lr, func(lineNum int, content []byte, ending string) bool {
+		if lineNum%1024 == 0 && ctx.Err() != nil {
+			return false
+		}
+		line := string(content)
+		name := line
+		if loc.HasAttributes(et) {
+			name = NameColumn(line)
+		}
+		for i, sg := range suggesters {
+			if sg == nil {
+				continue
+			}
+			if res[i].MatchString(NameColumn(line)) {
+				suggesters[i] = nil // has results now
+				pending--
+				continue
+			}
+			sg.Add(name)
+		}
+		return pending > 0
+	})
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	if err != nil {
+		s.logger.Error("error reading name file", zap.Error(err), zap.String(ZAP_PATH, path))
+	} else if lr.N == 0 {
+		return names, true // too large to suggest names from
+	}
+	for i, sg := range suggesters {
+		if sg != nil {
+			names[i] = sg.suggestions
+		}
+	}
+	return names, true
+}
+
+// MineZeroResults looks at the queries in f that had no results, finds the names they were close to, and proposes
+// replacements for the differences many queries share, and could-bes for the rest.
+// Queries that now have results, or already have a could-be, are skipped.
+// If ctx is done first, the proposals from the queries looked at so far are returned, and the report is Truncated.
+func (s *Server) MineZeroResults(ctx context.Context, f ReportFilter) (MiningReport, error) {
+	report := MiningReport{Filter: f, Proposals: []RuleProposal{}}
+	ns := s.Names()
+	queries, err := s.zeroResultQueries(ctx, ns, f)
+	if err != nil && ctx.Err() != nil {
+		report.Truncated = true
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+	report.Mined = len(queries)
+
+	existing := make(map[string]bool)
+	for _, r := range s.cachedReplacements {
+		existing[r.Key] = true
+	}
+
+	replacements := make(map[[2]string]*proposalCluster)
+	couldBes := make(map[[2]string]*proposalCluster)
+	cluster := func(clusters map[[2]string]*proposalCluster, kind, key, val string) *proposalCluster {
+		k := [2]string{key, val}
+		c, ok := clusters[k]
+		if !ok {
+			c = &proposalCluster{RuleProposal: RuleProposal{Kind: kind, Key: key, Val: val}, queries: make(map[string]bool)}
+			clusters[k] = c
+		}
+		return c
+	}
+
+	// Group the queries by name file, so each file is only read once. The files of the most searched queries are first.
+	type fileKey struct {
+		locationID int
+		et         EntryType
+	}
+	groups := make(map[fileKey][]zeroResultQuery)
+	groupOrder := []fileKey{}
+	for _, q := range queries {
+		if QueryLiteral(q.query) == "" || len(s.MatchCouldBes(q.query, q.loc, q.et)) > 0 {
+			continue
+		}
+		key := fileKey{q.loc.ID, q.et}
+		if _, ok := groups[key]; !ok {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], q)
+	}
+
+	for gi, key := range groupOrder {
+		group := groups[key]
+		names, ok := s.mineFile(ctx, ns, group[0].loc, key.et, group)
+		if !ok {
+			report.Truncated = true
+			for _, key := range groupOrder[gi:] {
+				report.Mined -= len(groups[key])
+			}
+			break
+		}
+
+		for i, q := range group {
+			if len(names[i]) == 0 {
+				continue
+			}
+			lit := []rune(QueryLiteral(q.query))
+			ex := MiningExample{Query: q.query, Location: q.loc.Abbr, EntryType: q.et, Searches: q.searches, Names: names[i]}
+			word := closestWord(lit, names[i][0].Name)
+			from, to := MineDiff(lit, word)
+			if from != "" && to != "" && len([]rune(from)) <= MAX_MINING_DIFF && len([]rune(to)) <= MAX_MINING_DIFF && !existing[from] {
+				cluster(replacements, MP_REPLACEMENT, from, "(?:"+regexp.QuoteMeta(from)+"|"+regexp.QuoteMeta(to)+")").add(ex)
+			}
+			if string(lit) != string(word) {
+				cluster(couldBes, MP_COULD_BE, string(lit), string(word)).add(ex)
+			}
+		}
+	}
+
+	// A difference only one query has is better as a could-be of that query
+	covered := make(map[string]bool)
+	for _, c := range replacements {
+		if c.Evidence.Queries < MIN_MINING_QUERIES {
+			continue
+		}
+		c.Scope = c.scope()
+		report.Proposals = append(report.Proposals, c.RuleProposal)
+		for q := range c.queries {
+			covered[q] = true
+		}
+	}
+	for _, c := range couldBes {
+		if covered[c.Evidence.Examples[0].Query] {
+			continue
+		}
+		c.Scope = c.scope()
+		report.Proposals = append(report.Proposals, c.RuleProposal)
+	}
+
+	sort.Slice(report.Proposals, func(i, j int) bool {
+		a, b := report.Proposals[i], report.Proposals[j]
+		if a.Evidence.Searches != b.Evidence.Searches {
+			return a.Evidence.Searches > b.Evidence.Searches
+		}
+		if a.Kind != b.Kind {
+			return a.Kind == MP_REPLACEMENT
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Val < b.Val
+	})
+	return report, nil
+}
+
+// MineHandler mines zero-result searches for proposed rules. It takes the same parameters as the analytics reports,
+// with 'limit' being how many distinct queries to look at.
+func (s *Server) MineHandler(w http.ResponseWriter, r *http.Request) {
+	f, errReason := s.NewReportFilter(r.URL.Query())
+	if errReason != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError(errReason))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), MINING_TIMEOUT)
+	defer cancel()
+	report, err := s.MineZeroResults(ctx, f)
+	if err != nil {
+		s.logger.Error("error mining zero-result searches", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+
+	enc, err := json.Marshal(report)
+	if err != nil {
+		s.logger.DPanic("error encoding mining report", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(enc)
+}
+
+// RunMine runs the mine subcommand, printing the rules proposed from zero-result searches.
+// Unlike the other subcommands it needs the database, for the searches and the current rules.
+func RunMine(logger *zap.Logger, args []string) int {
+	flags := flag.NewFlagSet("mine", flag.ContinueOnError)
+	from := flags.String("from", "", "only searches since this date (default 30 days ago)")
+	to := flags.String("to", "", "only searches before this date (default now)")
+	location := flags.String("location", "", "only searches of this location abbreviation")
+	limit := flags.Int("limit", REPORT_DEFAULT_LIMIT, "how many distinct queries to look at")
+	asJson := flags.Bool("json", false, "print the proposals as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config := LoadConfig(logger)
+	if config.DBString == "" {
+		fmt.Fprintln(os.Stderr, "no DB_STRING provided")
+		return 2
+	}
+	nameFolder, err := ActiveNameFolder()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error finding active names folder:", err)
+		return 2
+	}
+	config.Autocomplete = false // not needed to mine
+	s := &Server{config: config, logger: logger}
+	s.InstallDB()
+	ns, err := s.LoadNameState(nameFolder)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error loading names:", err)
+		return 2
+	}
+	s.PublishNames(ns)
+	s.InstallReplacements()
+	s.InstallMacros()
+	s.InstallCouldBes()
+
+	params := url.Values{"from": {*from}, "to": {*to}, "location": {*location}, "limit": {strconv.Itoa(*limit)}}
+	f, errReason := s.NewReportFilter(params)
+	if errReason != "" {
+		fmt.Fprintln(os.Stderr, errReason)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), MINING_TIMEOUT)
+	defer cancel()
+	report, err := s.MineZeroResults(ctx, f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error mining:", err)
+		return 2
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return 0
+	}
+	fmt.Printf("mined %d zero-result queries, %d proposals\n", report.Mined, len(report.Proposals))
+	if report.Truncated {
+		fmt.Println("ran out of time, so not every query was mined")
+	}
+	for _, p := range report.Proposals {
+		fmt.Printf("\n%s %q -> %q", p.Kind, p.Key, p.Val)
+		if len(p.Locations) > 0 || len(p.EntryTypes) > 0 {
+			fmt.Printf(" (locations %v, entry types %v)", p.Locations, p.EntryTypes)
+		}
+		fmt.Printf("\n  %d searches of %d queries\n", p.Evidence.Searches, p.Evidence.Queries)
+		for _, ex := range p.Evidence.Examples {
+			names := []string{}
+			for _, n := range ex.Names {
+				names = append(names, n.Name)
+			}
+			fmt.Printf("  %q in %s/%s x%d: %s\n", ex.Query, ex.Location, ex.EntryType, ex.Searches, strings.Join(names, ", "))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// multiMatcher gives the lines read by one search for several queries to the queries they match, until each query
+// has all the results it asked for.
+type multiMatcher struct {
+	queries []string
+	res     []*regexp.Regexp // nil once a query is invalid or has all its results
+	nums    []int
+	results [][]Entry
+	valid   []bool
+	pending int // queries that still want results
+}
+
+// newMultiMatcher compiles several queries, logging any that are invalid. nums[i] is the most results for queries[i].
+func (s *Server) newMultiMatcher(queries []string, nums []int) *multiMatcher {
+	m := &multiMatcher{
+		queries: queries,
+		res:     make([]*regexp.Regexp, len(queries)),
+		nums:    nums,
+		results: make([][]Entry, len(queries)),
+		valid:   make([]bool, len(queries)),
+	}
+	for i, query := range queries {
+		m.results[i] = []Entry{}
+		re, err := CompileQuery(query)
+		if err != nil {
+			s.logger.Warn("invalid query", zap.String("query", query), zap.Error(err))
+			continue
+		}
+		m.valid[i] = true
+		if nums[i] > 0 {
+			m.res[i] = re
+			m.pending++
+		}
+	}
+	return m
+}
+
+// patterns returns the rg arguments that match any of the queries still wanting results.
+func (m *multiMatcher) patterns() []string {
+	args := []string{}
+	for i, re := range m.res {
+		if re != nil {
+			args = append(args, "-e", m.queries[i])
+		}
+	}
+	return args
+}
+
+// add gives the entry of a line to each query matching searchable, the part of the line they match against.
+// It returns whether any queries still want results.
+func (m *multiMatcher) add(searchable string, entry func() Entry) bool {
+	var e *Entry // only created if something matches
+	for i, re := range m.res {
+		if re == nil || !re.MatchString(searchable) {
+			continue
+		}
+		if e == nil {
+			created := entry()
+			e = &created
+		}
+		m.results[i] = append(m.results[i], *e)
+		if len(m.results[i]) >= m.nums[i] {
+			m.res[i] = nil // done
+			m.pending--
+		}
+	}
+	return m.pending > 0
+}
+
+// MultiSearch runs several specific searches of the same name file, reading it only once. nums[i] is the maximum
+// number of results for queries[i]. Like IndividualSearch, files with attribute columns are searched natively; others
+// are searched by one rg run for every query, with each line it finds matched again to tell which queries found it.
+// It returns the results and whether each query was valid, or false if the file couldn't be searched.
+// If ctx is done, it stops early and returns what it has found so far.
+func (s *Server) MultiSearch(ctx context.Context, ns *NameState, queries []string, nums []int, loc *Location, typ EntryType, allColumns bool) ([][]Entry, []bool, bool) {
+	if loc.HasAttributes(typ) && !allColumns {
+		return s.NativeMultiSearch(ctx, ns, queries, nums, loc, typ)
+	}
+
+	m := s.newMultiMatcher(queries, nums)
+	if m.pending == 0 {
+		return m.results, m.valid, true
+	}
+	path, ok := NameFilePath(ns.Folder, loc, typ)
+	if !ok {
+		s.logger.Info("file doesn't exist", zap.String(ZAP_PATH, path))
+		return m.results, m.valid, true // No results, but not a user error
+	}
+
+	args := []string{"--crlf", "-i", "-n"}
+	if IsCompressed(path) {
+		args = append(args, "--search-zip")
+	}
+	args = append(append(args, m.patterns()...), path)
+
+	rel := RelativeNamePath(ns.Folder, path)
+	ok = s.runRipgrep(ctx, args, strings.Join(queries, ", "), func(l string) bool {
+		parts := strings.SplitN(l, ":", 2) // [0] is the line number
+		if len(parts) != 2 {
+			return true
+		}
+		lineNum, _ := strconv.Atoi(parts[0])
+		return m.add(strings.TrimSuffix(parts[1], "\r"), func() Entry {
+			return loc.NewEntry(parts[1], typ, rel, lineNum)
+		})
+	})
+	return m.results, m.valid, ok
+}
+
+// ExtendedMultiSearch runs several extended searches from the same location, reading each name file only once.
+// nums[i] is the maximum number of results for queries[i]. Like ExtendedSearch, files with attribute columns are
+// searched natively, unless allColumns is set.
+// It returns the results and whether each query was valid, or false if the files couldn't be searched.
+// If ctx is done, it stops early and returns what it has found so far.
+func (s *Server) ExtendedMultiSearch(ctx context.Context, ns *NameState, queries []string, nums []int, loc *Location, typ EntryType, allColumns bool) ([][]Entry, []bool, bool) {
+	m := s.newMultiMatcher(queries, nums)
+	plain, native := extendedFiles(ns, loc, typ, allColumns)
+
+	ok := true
+	if m.pending > 0 && len(plain) > 0 {
+		args, paths := extendedArgs(plain)
+		args = append(append(args, m.patterns()...), paths...)
+		ok = s.runRipgrep(ctx, args, strings.Join(queries, ", "), func(l string) bool {
+			e, line, ok := parseExtendedLine(ns, plain, typ, l)
+			if !ok {
+				return true
+			}
+			return m.add(strings.TrimSuffix(line, "\r"), func() Entry { return e })
+		})
+	}
+	for _, l := range native {
+		if !ok || m.pending == 0 || ctx.Err() != nil {
+			break
+		}
+		ok = s.nativeMatch(ctx, ns, m, l, typ)
+	}
+	return m.results, m.valid, ok
+}
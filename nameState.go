@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// NameState is everything derived from the active names folder. It is never modified once published: refreshes and
+// version switches build a new one and swap it in with a single store, so a handler that takes it once (with Names)
+// sees one consistent folder, set of locations, and file stats, even if a switch happens part way through.
+type NameState struct {
+	Folder          string            // the active names folder: NAME_FOLDER, or one of its versions
+	Locations       map[int]*Location // id -> location
+	CachedLocations []byte            // JSON encoded list of locations, in order to avoid having to reparse again and again
+
+	// For counts
+	FileLengths  map[EntryType]map[int]int64 // FileLengths[EntryType][Location.Id] = length
+	TotalLengths map[EntryType]int64
+	EntryCounts  map[EntryType]map[int]int64 // EntryCounts[EntryType][Location.Id] = non-blank lines
+	TotalEntries map[EntryType]int64
+
+	Autocomplete map[string]*AutocompleteIndex // by diffKey, nil if disabled
+
+	Generation uint64 // set when published, used for ETags
+}
+
+// Names returns the current NameState.
+func (s *Server) Names() *NameState {
+	return s.nameState.Load().(*NameState)
+}
+
+// PublishNames makes ns the current NameState. It must not be modified afterwards.
+// Only one goroutine publishes at a time, as they hold refreshMux.
+func (s *Server) PublishNames(ns *NameState) {
+	s.generation++
+	ns.Generation = s.generation
+	s.nameState.Store(ns)
+}
+
+// Copy returns a shallow copy of a NameState, to replace some of its fields before publishing it.
+func (ns *NameState) Copy() *NameState {
+	c := *ns
+	return &c
+}
+
+// InstallNames reloads the active names folder and publishes it.
+func (s *Server) InstallNames() {
+	ns, err := s.LoadNameState(s.Names().Folder)
+	if err != nil {
+		s.logger.Panic(err.Error())
+	}
+	s.PublishNames(ns)
+	s.logger.Info("names", zap.String(ZAP_PATH, ns.Folder), zap.Int("num_locations", len(ns.Locations)), zap.Int("num_autocomplete_indexes", len(ns.Autocomplete)))
+}
+
+// LoadNameState reads the locations and file stats of a names folder, and builds its autocomplete indexes if enabled.
+func (s *Server) LoadNameState(folder string) (*NameState, error) {
+	locations, err := s.LoadLocations(folder)
+	if err != nil {
+		return nil, err
+	}
+	ns := &NameState{Folder: folder, Locations: locations}
+	ns.CachedLocations = s.EncodeLocations(locations)
+	ns.SetFileStats(s.ReadFileStats(folder, locations))
+	if s.config.Autocomplete {
+		ns.Autocomplete = s.BuildAutocomplete(folder, LocationList(locations))
+	}
+	return ns, nil
+}
+
+// EncodeLocations returns the JSON encoded list of locations, sorted by abbreviation.
+func (s *Server) EncodeLocations(locations map[int]*Location) []byte {
+	loc := LocationList(locations)
+	sort.Slice(loc, func(i, j int) bool {
+		return loc[i].Abbr < loc[j].Abbr
+	})
+	enc, err := json.Marshal(loc)
+	if err != nil {
+		s.logger.DPanic("error marshaling locations", zap.Error(err))
+		return []byte("[]")
+	}
+	return enc
+}
+
+// LocationList returns the locations of a map as a slice, in no particular order.
+func LocationList(locations map[int]*Location) []*Location {
+	list := make([]*Location, 0, len(locations))
+	for _, l := range locations {
+		list = append(list, l)
+	}
+	return list
+}
+
+// LookupLocationByAbbr takes a locationAbbr and returns the associated Location.
+func (ns *NameState) LookupLocationByAbbr(locationAbbr string) (*Location, bool) {
+	for _, e := range ns.Locations {
+		if e.Abbr == locationAbbr {
+			return e, true
+		}
+	}
+	return &Location{}, false
+}
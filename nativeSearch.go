@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// CompileQuery compiles a (formatted) query the way rg would interpret it: case-insensitively.
+func CompileQuery(query string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)" + query)
+}
+
+// NameColumn returns the searchable name of a line, i.e. everything before the first tab.
+func NameColumn(line string) string {
+	if i := strings.IndexByte(line, '\t'); i != -1 {
+		return line[:i]
+	}
+	return line
+}
+
+// NativeSearch runs a specific (1 location) search in Go rather than with rg, matching only the name column of each line,
+// and passing each entry to found. It returns how many were found.
+// It's used for name files with attribute columns, which rg can't restrict a match to.
+func (s *Server) NativeSearch(ctx context.Context, ns *NameState, query string, loc *Location, typ EntryType, num int, found EntryFunc) (int, bool) {
+	re, err := CompileQuery(query)
+	if err != nil {
+		s.logger.Warn("invalid query", zap.String("query", query), zap.Error(err))
+		return 0, false
+	}
+	if num <= 0 {
+		return 0, true
+	}
+
+	numFound := 0
+	ok := s.scanNameFile(ctx, ns, loc, typ, func(line, rel string, lineNum int) bool {
+		if !re.MatchString(NameColumn(line)) {
+			return true
+		}
+		numFound++
+		return found(loc.NewEntry(line, typ, rel, lineNum)) && numFound < num
+	})
+	return numFound, ok
+}
+
+// NativeMultiSearch runs several specific searches against the same name file in Go, reading it only once and matching
+// only the name column of each line. nums[i] is the maximum number of results for queries[i].
+// It returns the results and whether each query was valid, or false if the file couldn't be read.
+// If ctx is done, it stops early and returns what it has found so far.
+func (s *Server) NativeMultiSearch(ctx context.Context, ns *NameState, queries []string, nums []int, loc *Location, typ EntryType) ([][]Entry, []bool, bool) {
+	m := s.newMultiMatcher(queries, nums)
+	ok := s.nativeMatch(ctx, ns, m, loc, typ)
+	return m.results, m.valid, ok
+}
+
+// nativeMatch reads a location's name file, giving each line's name to the queries m is still matching.
+func (s *Server) nativeMatch(ctx context.Context, ns *NameState, m *multiMatcher, loc *Location, typ EntryType) bool {
+	if m.pending == 0 {
+		return true
+	}
+	return s.scanNameFile(ctx, ns, loc, typ, func(line, rel string, lineNum int) bool {
+		return m.add(NameColumn(line), func() Entry {
+			return loc.NewEntry(line, typ, rel, lineNum)
+		})
+	})
+}
+
+// scanNameFile calls fn with each line of a location's name file, and its path relative to the names folder, until fn
+// returns false or ctx is done. A missing file has no lines. It returns false if the file couldn't be read.
+func (s *Server) scanNameFile(ctx context.Context, ns *NameState, loc *Location, typ EntryType, fn func(line, rel string, lineNum int) bool) bool {
+	path, ok := NameFilePath(ns.Folder, loc, typ)
+	if !ok {
+		s.logger.Info("file doesn't exist", zap.String(ZAP_PATH, path))
+		return true // No results, but not a user error
+	}
+
+	f, err := OpenNameFile(path)
+	if err != nil {
+		s.logger.Error("error opening name file", zap.Error(err), zap.String(ZAP_PATH, path))
+		return false
+	}
+	defer f.Close()
+
+	rel := RelativeNamePath(ns.Folder, path)
+	err = ScanNameLines(f, func(lineNum int, content []byte, ending string) bool {
+		if lineNum%1024 == 0 && ctx.Err() != nil {
+			return false
+		}
+		return fn(string(content), rel, lineNum)
+	})
+	if err != nil {
+		s.logger.Error("error reading name file", zap.Error(err), zap.String(ZAP_PATH, path))
+		return false
+	}
+	return true
+}
@@ -2,41 +2,188 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 
 	"go.uber.org/zap"
 )
 
 // Replacement represents a custom substitution in a query, used to make regular expressions more indexing-friendly.
+//
+// Replacements are applied one after another, each to the result of the last: highest Priority first,
+// then longest Key first (so "sch" is replaced before "ch"), then in the order they were created.
 type Replacement struct {
-	Key string `json:"key"`
-	Val string `json:"val"`
+	ID       int    `json:"id"`
+	Key      string `json:"key"`
+	Val      string `json:"val"`
+	Priority int    `json:"priority"`
+	IsRegex  bool   `json:"is_regex"` // Key is a regular expression, and Val may refer to its groups ($1)
+	Scope
+
+	re *regexp.Regexp // compiled Key, if IsRegex
+}
+
+// Scope limits a rule to some locations and entry types. Empty means every location or entry type.
+type Scope struct {
+	Locations  []string    `json:"locations,omitempty"` // abbreviations
+	EntryTypes []EntryType `json:"entry_types,omitempty"`
+}
+
+// NewScope creates a Scope from the comma-separated lists stored in the database.
+func NewScope(locations, entryTypes string) Scope {
+	sc := Scope{Locations: SplitList(locations)}
+	for _, et := range SplitList(entryTypes) {
+		sc.EntryTypes = append(sc.EntryTypes, EntryType(strings.ToUpper(et)))
+	}
+	return sc
+}
+
+// InvalidRule is a replacement (or other rule) that was skipped when installing, and why.
+type InvalidRule struct {
+	ID     int    `json:"id"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// AppliesTo returns whether a location and entry type are in scope.
+func (r Scope) AppliesTo(loc *Location, et EntryType) bool {
+	if len(r.Locations) > 0 {
+		ok := false
+		for _, abbr := range r.Locations {
+			if loc != nil && abbr == loc.Abbr {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.EntryTypes) > 0 {
+		for _, t := range r.EntryTypes {
+			if t == et {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Apply substitutes the replacement in q.
+func (r Replacement) Apply(q string) string {
+	if r.IsRegex {
+		return r.re.ReplaceAllString(q, r.Val)
+	}
+	return strings.ReplaceAll(q, r.Key, r.Val)
+}
+
+// SplitList splits a comma-separated list from the database, ignoring blanks.
+func SplitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-// InstallReplacements retrieves all replacements from the database and populates the server's cache.
+// validate checks a replacement, compiling its Key if it's a regular expression.
+func (s *Server) validateReplacement(r *Replacement) error {
+	if r.Key == "" {
+		return errors.New("blank key")
+	}
+
+	if r.IsRegex {
+		re, err := regexp.Compile(r.Key)
+		if err != nil {
+			return fmt.Errorf("invalid key regex: %w", err)
+		}
+		r.re = re
+	} else if _, err := regexp.Compile(r.Val); err != nil {
+		// The value ends up in the query, so must be a valid regex fragment on its own
+		return fmt.Errorf("invalid val regex: %w", err)
+	}
+
+	return s.validateScope(r.Scope)
+}
+
+// validateScope checks that every location and entry type in a Scope exists.
+func (s *Server) validateScope(sc Scope) error {
+	for _, abbr := range sc.Locations {
+		if _, ok := s.Names().LookupLocationByAbbr(abbr); !ok {
+			return fmt.Errorf("unknown location %q", abbr)
+		}
+	}
+	for _, et := range sc.EntryTypes {
+		switch et {
+		case ENTRY_TYPES[0], ENTRY_TYPES[1], ENTRY_TYPES[2]:
+		default:
+			return fmt.Errorf("unknown entry type %q", et)
+		}
+	}
+	return nil
+}
+
+// InstallReplacements retrieves all replacements from the database, validates and orders them, and populates the server's cache.
+// Invalid replacements are logged and skipped.
+//
+// Depends on InstallLocations.
 func (s *Server) InstallReplacements() {
-	s.cachedReplacements = make(map[string]string)
+	replacements := []Replacement{}
+	invalid := []InvalidRule{}
 
-	rows, _ := s.conn.Query(context.Background(), "SELECT key, val FROM replacements")
+	rows, _ := s.conn.Query(context.Background(), "SELECT id, key, COALESCE(val, ''), priority, is_regex, COALESCE(locations, ''), COALESCE(entry_types, '') FROM replacements")
 	defer rows.Close()
 	for rows.Next() {
-		var key, val string
-		err := rows.Scan(&key, &val)
+		var r Replacement
+		var locations, entryTypes string
+		err := rows.Scan(&r.ID, &r.Key, &r.Val, &r.Priority, &r.IsRegex, &locations, &entryTypes)
 		if err != nil {
 			s.logger.DPanic("error getting replacement", zap.Error(err))
 			continue
 		}
-		s.cachedReplacements[key] = val
+		r.Scope = NewScope(locations, entryTypes)
+
+		if err := s.validateReplacement(&r); err != nil {
+			s.logger.Error("invalid replacement", zap.Int("id", r.ID), zap.String("key", r.Key), zap.Error(err))
+			invalid = append(invalid, InvalidRule{ID: r.ID, Key: r.Key, Reason: err.Error()})
+			continue
+		}
+		replacements = append(replacements, r)
 	}
 
-	s.logger.Info("replacements", zap.Int("num", len(s.cachedReplacements)))
+	sort.SliceStable(replacements, func(i, j int) bool {
+		a, b := replacements[i], replacements[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if len(a.Key) != len(b.Key) {
+			return len(a.Key) > len(b.Key)
+		}
+		return a.ID < b.ID
+	})
+
+	s.cachedReplacements = replacements
+	s.invalidReplacements = invalid
+	s.logger.Info("replacements", zap.Int("num", len(replacements)), zap.Int("invalid", len(invalid)))
 }
 
-// DoReplacements takes the query, substitutes any replacements, and then returns the final query.
-func (s *Server) DoReplacements(q string) string {
-	for k, v := range s.cachedReplacements {
-		if strings.Contains(q, k) {
-			q = strings.ReplaceAll(q, k, v)
+// DoReplacements takes the query, substitutes any replacements in scope for the location and entry type, and then returns the final query.
+// If steps isn't nil, every replacement that changed the query is appended to it.
+func (s *Server) DoReplacements(q string, loc *Location, et EntryType, steps *[]SearchStep) string {
+	for _, r := range s.cachedReplacements {
+		if !r.AppliesTo(loc, et) {
+			continue
+		}
+		before := q
+		q = r.Apply(q)
+		if steps != nil && q != before {
+			*steps = append(*steps, SearchStep{Stage: "replacement", RuleID: r.ID, Key: r.Key, Val: r.Val, Before: before, After: q})
 		}
 	}
 	return q
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgtype"
+	"go.uber.org/zap"
+)
+
+const (
+	// REPORT_DEFAULT_RANGE is how far back reports go if no 'from' is given.
+	REPORT_DEFAULT_RANGE = 30 * 24 * time.Hour
+	// REPORT_DEFAULT_TO_PRECISION is what the default 'to' (now) is truncated to, so reports without one can be cached.
+	REPORT_DEFAULT_TO_PRECISION = time.Minute
+
+	REPORT_DEFAULT_LIMIT int = 100
+	REPORT_MAX_LIMIT     int = 10000
+)
+
+// REPORT_BUCKETS are the time buckets allowed in the timeline report, as date_trunc fields.
+var REPORT_BUCKETS = map[string]bool{"hour": true, "day": true, "week": true, "month": true}
+
+// ReportFilter limits which searches a report covers.
+type ReportFilter struct {
+	From     time.Time  `json:"from"`
+	To       time.Time  `json:"to"`
+	Location *Location  `json:"location,omitempty"`
+	Type     SearchType `json:"-"` // 0 for every type
+	Limit    int        `json:"-"`
+}
+
+// parseReportTime parses a date (2006-01-02) or an RFC 3339 time.
+func parseReportTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// NewReportFilter creates a ReportFilter from the 'from', 'to', 'location', 'type', and 'limit' parameters.
+// It returns the reason if any of them are invalid.
+func (s *Server) NewReportFilter(params url.Values) (ReportFilter, string) {
+	f := ReportFilter{To: time.Now().Truncate(REPORT_DEFAULT_TO_PRECISION), Limit: REPORT_DEFAULT_LIMIT}
+	var err error
+	if to := params.Get("to"); to != "" {
+		if f.To, err = parseReportTime(to); err != nil {
+			return f, "invalid 'to' parameter provided. Should be a date or RFC 3339 time"
+		}
+	}
+	f.From = f.To.Add(-REPORT_DEFAULT_RANGE)
+	if from := params.Get("from"); from != "" {
+		if f.From, err = parseReportTime(from); err != nil {
+			return f, "invalid 'from' parameter provided. Should be a date or RFC 3339 time"
+		}
+	}
+
+	if abbr := params.Get("location"); abbr != "" {
+		loc, ok := s.Names().LookupLocationByAbbr(abbr)
+		if !ok {
+			return f, RS_INVALID_LOCATION
+		}
+		f.Location = loc
+	}
+	if typ := params.Get("type"); typ != "" {
+		st, ok := NewSearchType(typ)
+		if !ok {
+			return f, "invalid 'type' parameter provided. Should be one of 'specific', 'fallback', or 'extended'"
+		}
+		f.Type = st
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return f, "invalid 'limit' parameter provided"
+		}
+		f.Limit = n
+	}
+	if f.Limit > REPORT_MAX_LIMIT {
+		f.Limit = REPORT_MAX_LIMIT
+	}
+	return f, ""
+}
+
+// Where returns the SQL conditions for the filter, on data_searches aliased as d, and their arguments.
+// Any extra conditions are ANDed on.
+func (f ReportFilter) Where(extra ...string) (string, []interface{}) {
+	conds := []string{"d.time >= $1", "d.time < $2"}
+	args := []interface{}{f.From, f.To}
+	if f.Location != nil {
+		args = append(args, f.Location.ID)
+		conds = append(conds, fmt.Sprintf("d.query_location = $%d", len(args)))
+	}
+	if f.Type != 0 {
+		args = append(args, f.Type)
+		conds = append(conds, fmt.Sprintf("d.search_type = $%d", len(args)))
+	}
+	conds = append(conds, extra...)
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Report is the response of every report.
+type Report struct {
+	Filter ReportFilter `json:"filter"`
+	Rows   interface{}  `json:"rows"`
+}
+
+// QueryCount is a query and how often it was searched.
+type QueryCount struct {
+	Query       string  `json:"query"`
+	Count       int64   `json:"count"`
+	AvgReturned float64 `json:"avg_returned"`
+}
+
+// ErrorCount is an error and how often it happened.
+type ErrorCount struct {
+	Error string `json:"error"`
+	Count int64  `json:"count"`
+}
+
+// LatencyRow is the distribution of durations (in milliseconds) for a search type and location.
+type LatencyRow struct {
+	Type     string  `json:"type"`
+	Location string  `json:"location"` // abbreviation, "" if none
+	Count    int64   `json:"count"`
+	P50      float64 `json:"p50"`
+	P90      float64 `json:"p90"`
+	P99      float64 `json:"p99"`
+	Max      int64   `json:"max"`
+}
+
+// UserCount is how much a user searched.
+type UserCount struct {
+	UserId uuid.UUID `json:"user_id"`
+	Count  int64     `json:"count"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+}
+
+// TimelineRow is the searches in one time bucket.
+type TimelineRow struct {
+	Bucket      time.Time `json:"bucket"`
+	Count       int64     `json:"count"`
+	ZeroResults int64     `json:"zero_results"`
+	Errors      int64     `json:"errors"`
+	AvgDuration float64   `json:"avg_duration"`
+}
+
+// queryCounts runs the top queries report, with extra conditions.
+func (s *Server) queryCounts(ctx context.Context, f ReportFilter, extra ...string) (interface{}, error) {
+	where, args := f.Where(extra...)
+	args = append(args, f.Limit)
+	rows, err := s.conn.Query(ctx, `SELECT d.query_raw, COUNT(*), COALESCE(AVG(d.num_returned), 0)::FLOAT8
+		FROM data_searches d `+where+`
+		GROUP BY d.query_raw ORDER BY COUNT(*) DESC, d.query_raw LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []QueryCount{}
+	for rows.Next() {
+		var qc QueryCount
+		var query pgtype.Text
+		if err := rows.Scan(&query, &qc.Count, &qc.AvgReturned); err != nil {
+			return nil, err
+		}
+		qc.Query = query.String
+		counts = append(counts, qc)
+	}
+	return counts, rows.Err()
+}
+
+// TopQueriesReport is the most searched queries that didn't fail.
+func (s *Server) TopQueriesReport(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error) {
+	return s.queryCounts(ctx, f, "COALESCE(d.error, '') = ''")
+}
+
+// ZeroResultsReport is the most searched queries that didn't fail, but had no results.
+func (s *Server) ZeroResultsReport(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error) {
+	return s.queryCounts(ctx, f, "COALESCE(d.error, '') = ''", "d.num_returned = 0")
+}
+
+// ErrorsReport is how often each error happened.
+func (s *Server) ErrorsReport(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error) {
+	where, args := f.Where("COALESCE(d.error, '') <> ''")
+	args = append(args, f.Limit)
+	rows, err := s.conn.Query(ctx, `SELECT d.error, COUNT(*)
+		FROM data_searches d `+where+`
+		GROUP BY d.error ORDER BY COUNT(*) DESC, d.error LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []ErrorCount{}
+	for rows.Next() {
+		var ec ErrorCount
+		if err := rows.Scan(&ec.Error, &ec.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, ec)
+	}
+	return counts, rows.Err()
+}
+
+// LatencyReport is the percentiles of search durations by search type and location.
+func (s *Server) LatencyReport(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error) {
+	where, args := f.Where("d.duration IS NOT NULL")
+	rows, err := s.conn.Query(ctx, `SELECT d.search_type, COALESCE(l.abbr, ''), COUNT(*),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY d.duration),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY d.duration),
+			percentile_cont(0.99) WITHIN GROUP (ORDER BY d.duration),
+			MAX(d.duration)
+		FROM data_searches d LEFT JOIN locations l ON l.id = d.query_location `+where+`
+		GROUP BY d.search_type, l.abbr ORDER BY d.search_type, l.abbr`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latencies := []LatencyRow{}
+	for rows.Next() {
+		var lr LatencyRow
+		var st pgtype.Int4
+		if err := rows.Scan(&st, &lr.Location, &lr.Count, &lr.P50, &lr.P90, &lr.P99, &lr.Max); err != nil {
+			return nil, err
+		}
+		lr.Type = SearchType(st.Int).String()
+		latencies = append(latencies, lr)
+	}
+	return latencies, rows.Err()
+}
+
+// UsersReport is the users who searched the most. Anonymous searches, recorded with the nil UUID, aren't counted.
+func (s *Server) UsersReport(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error) {
+	where, args := f.Where("d.user_id IS NOT NULL", "d.user_id <> '"+uuid.Nil.String()+"'")
+	args = append(args, f.Limit)
+	rows, err := s.conn.Query(ctx, `SELECT d.user_id, COUNT(*), MIN(d.time), MAX(d.time)
+		FROM data_searches d `+where+`
+		GROUP BY d.user_id ORDER BY COUNT(*) DESC, d.user_id LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserCount{}
+	for rows.Next() {
+		var uc UserCount
+		var id pgtype.UUID
+		if err := rows.Scan(&id, &uc.Count, &uc.First, &uc.Last); err != nil {
+			return nil, err
+		}
+		uc.UserId = uuid.UUID(id.Bytes)
+		users = append(users, uc)
+	}
+	return users, rows.Err()
+}
+
+// TimelineReport is the number of searches, failures, and zero-result searches in each time bucket ('bucket' is hour, day, week, or month).
+func (s *Server) TimelineReport(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error) {
+	bucket := params.Get("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if !REPORT_BUCKETS[bucket] {
+		return nil, errReportParam("invalid 'bucket' parameter provided. Should be one of 'hour', 'day', 'week', or 'month'")
+	}
+
+	where, args := f.Where()
+	// bucket is one of REPORT_BUCKETS, so it's safe to include
+	rows, err := s.conn.Query(ctx, `SELECT date_trunc('`+bucket+`', d.time) AS bucket, COUNT(*),
+			COUNT(*) FILTER (WHERE COALESCE(d.error, '') = '' AND d.num_returned = 0),
+			COUNT(*) FILTER (WHERE COALESCE(d.error, '') <> ''),
+			COALESCE(AVG(d.duration), 0)::FLOAT8
+		FROM data_searches d `+where+`
+		GROUP BY bucket ORDER BY bucket`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timeline := []TimelineRow{}
+	for rows.Next() {
+		var tr TimelineRow
+		if err := rows.Scan(&tr.Bucket, &tr.Count, &tr.ZeroResults, &tr.Errors, &tr.AvgDuration); err != nil {
+			return nil, err
+		}
+		timeline = append(timeline, tr)
+	}
+	return timeline, rows.Err()
+}
+
+// errReportParam is an error caused by an invalid parameter, rather than the database.
+type errReportParam string
+
+func (e errReportParam) Error() string {
+	return string(e)
+}
+
+// ReportFunc computes the rows of a report.
+type ReportFunc func(ctx context.Context, f ReportFilter, params url.Values) (interface{}, error)
+
+// ReportCache keeps encoded reports for a while, so dashboards refreshing them don't rerun the queries.
+type ReportCache struct {
+	mux     sync.Mutex
+	ttl     time.Duration
+	entries map[string]reportCacheEntry
+}
+
+type reportCacheEntry struct {
+	enc     []byte
+	expires time.Time
+}
+
+// NewReportCache creates a ReportCache. A ttl of 0 disables it.
+func NewReportCache(ttl time.Duration) *ReportCache {
+	return &ReportCache{ttl: ttl, entries: make(map[string]reportCacheEntry)}
+}
+
+// Get returns a cached report, if it hasn't expired.
+func (rc *ReportCache) Get(key string) ([]byte, bool) {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	e, ok := rc.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.enc, true
+}
+
+// Put caches a report, removing any that have expired.
+func (rc *ReportCache) Put(key string, enc []byte) {
+	if rc.ttl <= 0 {
+		return
+	}
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	now := time.Now()
+	for k, e := range rc.entries {
+		if now.After(e.expires) {
+			delete(rc.entries, k)
+		}
+	}
+	rc.entries[key] = reportCacheEntry{enc: enc, expires: now.Add(rc.ttl)}
+}
+
+// Clear removes every cached report, such as after analytics are deleted.
+func (rc *ReportCache) Clear() {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	rc.entries = make(map[string]reportCacheEntry)
+}
+
+// ReportHandler serves a report as JSON, filtered by the request's parameters.
+func (s *Server) ReportHandler(report ReportFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		f, errReason := s.NewReportFilter(params)
+		if errReason != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError(errReason))
+			return
+		}
+		// Keyed by the range the filter resolved to as well, as a missing 'to' or 'from' depends on when it was asked for
+		key := r.URL.Path + "?" + params.Encode() + "#" + f.From.Format(time.RFC3339) + "/" + f.To.Format(time.RFC3339) // Encode sorts by key
+
+		write := func(enc []byte) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(s.config.ReportCacheTTL.Seconds())))
+			w.Write(enc)
+		}
+		if enc, ok := s.reports.Get(key); ok {
+			write(enc)
+			return
+		}
+
+		rows, err := report(r.Context(), f, params)
+		if paramErr, ok := err.(errReportParam); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError(paramErr.Error()))
+			return
+		} else if err != nil {
+			s.logger.Error("error running report", zap.String(ZAP_PATH, r.URL.Path), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(MarshalError("internal error"))
+			return
+		}
+
+		enc, err := json.Marshal(Report{Filter: f, Rows: rows})
+		if err != nil {
+			s.logger.DPanic("error encoding report", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(MarshalError("internal error"))
+			return
+		}
+		s.reports.Put(key, enc)
+		write(enc)
+	}
+}
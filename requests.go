@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgtype"
+)
+
+// RequestAnalytic records a request to any endpoint.
+type RequestAnalytic struct {
+	Time     time.Time
+	Endpoint string // the pattern the request was routed by, so unknown paths are all "/"
+	Method   string
+	Params   map[string][]string
+	UserId   pgtype.UUID // from the id parameter, if any
+	Status   int
+	Duration int // ms
+	Bytes    int64
+
+	// Detail is anything else the handler wants recorded, see SetRequestDetail.
+	Detail string
+}
+
+// Table implements AnalyticEvent.
+func (ra *RequestAnalytic) Table() string {
+	return "data_requests"
+}
+
+// Columns implements AnalyticEvent.
+func (ra *RequestAnalytic) Columns() []string {
+	return []string{"time", "endpoint", "method", "params", "user_id", "status", "duration", "bytes", "detail"}
+}
+
+// Values implements AnalyticEvent.
+func (ra *RequestAnalytic) Values() []interface{} {
+	params := pgtype.JSONB{Status: pgtype.Null}
+	if len(ra.Params) > 0 {
+		if enc, err := json.Marshal(ra.Params); err == nil {
+			params = pgtype.JSONB{Bytes: enc, Status: pgtype.Present}
+		}
+	}
+	detail := pgtype.Text{Status: pgtype.Null}
+	if ra.Detail != "" {
+		detail = pgtype.Text{String: ra.Detail, Status: pgtype.Present}
+	}
+	return []interface{}{ra.Time, ra.Endpoint, ra.Method, params, ra.UserId, ra.Status, ra.Duration, ra.Bytes, detail}
+}
+
+type requestAnalyticKey struct{}
+
+// SetRequestDetail adds a detail to the RequestAnalytic of a request, such as what was shown to the user.
+func SetRequestDetail(r *http.Request, detail string) {
+	if ra, ok := r.Context().Value(requestAnalyticKey{}).(*RequestAnalytic); ok {
+		ra.Detail = detail
+	}
+}
+
+// RedactRequestParams stops the parameters of a request from being recorded, such as when they identify a user.
+func RedactRequestParams(r *http.Request) {
+	if ra, ok := r.Context().Value(requestAnalyticKey{}).(*RequestAnalytic); ok {
+		ra.Params = nil
+	}
+}
+
+// recordingResponseWriter counts what is written to a response.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets results keep being streamed.
+func (rw *recordingResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RecordRequests records a RequestAnalytic of every request handled by mux.
+func (s *Server) RecordRequests(mux *http.ServeMux) http.Handler {
+	if !s.config.RequestAnalytics {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		params := r.URL.Query()
+		ra := &RequestAnalytic{
+			Time:     time.Now(),
+			Endpoint: pattern,
+			Method:   r.Method,
+			Params:   params,
+			UserId:   pgtype.UUID{Status: pgtype.Null},
+		}
+		if id, err := uuid.FromString(params.Get("id")); err == nil {
+			ra.UserId = pgtype.UUID{Bytes: id, Status: pgtype.Present}
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		mux.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), requestAnalyticKey{}, ra)))
+
+		ra.Status = rw.status
+		if ra.Status == 0 {
+			ra.Status = http.StatusOK
+		}
+		ra.Bytes = rw.bytes
+		ra.Duration = int(time.Since(ra.Time).Milliseconds())
+		s.analytics.Add(ra)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Result formats
+const (
+	RF_JSON  string = "json" // the default, a single JSON array
+	RF_JSONL string = "jsonl"
+	RF_CSV   string = "csv"
+	RF_TSV   string = "tsv"
+)
+
+// Export limits, for any format other than RF_JSON.
+const (
+	MAX_EXPORT_RESULTS            int = 1000
+	MAX_EXPORT_RESULTS_AUTHORIZED int = 100000
+)
+
+// ResultWriter writes search results to a client as they are found, rather than buffering them all.
+type ResultWriter interface {
+	Write(e Entry) error
+	// Flush sends anything written so far to the client.
+	Flush()
+	// Close finishes the response. It doesn't close the underlying writer.
+	Close() error
+}
+
+// IsResultFormat returns whether format is a valid result format ("" is RF_JSON).
+func IsResultFormat(format string) bool {
+	switch format {
+	case "", RF_JSON, RF_JSONL, RF_CSV, RF_TSV:
+		return true
+	}
+	return false
+}
+
+// IsExportFormat returns whether format is meant for downloading, with larger limits.
+func IsExportFormat(format string) bool {
+	return format != "" && format != RF_JSON
+}
+
+// NewResultWriter sets the headers for a result format and returns a ResultWriter for it.
+// attributes are the attribute columns to include in CSV and TSV files, and fileName is the download's name without an extension.
+func NewResultWriter(w http.ResponseWriter, format string, attributes []string, fileName string) ResultWriter {
+	flusher, _ := w.(http.Flusher)
+	disposition := func(ext string) {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+"."+ext+`"`)
+	}
+
+	switch format {
+	case RF_JSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		disposition("jsonl")
+		return &jsonlResultWriter{enc: json.NewEncoder(w), flusher: flusher}
+	case RF_CSV, RF_TSV:
+		cw := csv.NewWriter(w)
+		if format == RF_TSV {
+			cw.Comma = '\t'
+			w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		}
+		disposition(format)
+		return &csvResultWriter{cw: cw, attributes: attributes, flusher: flusher}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		return &jsonResultWriter{w: w, flusher: flusher}
+	}
+}
+
+// jsonResultWriter writes a JSON array, one element at a time.
+type jsonResultWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	started bool
+}
+
+func (j *jsonResultWriter) Write(e Entry) error {
+	enc, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	sep := []byte(",")
+	if !j.started {
+		sep = []byte("[")
+		j.started = true
+	}
+	_, err = j.w.Write(append(sep, enc...))
+	return err
+}
+
+func (j *jsonResultWriter) Flush() {
+	if j.flusher != nil {
+		j.flusher.Flush()
+	}
+}
+
+func (j *jsonResultWriter) Close() error {
+	end := []byte("]")
+	if !j.started {
+		end = []byte("[]")
+	}
+	_, err := j.w.Write(end)
+	return err
+}
+
+// jsonlResultWriter writes one JSON object per line.
+type jsonlResultWriter struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+func (j *jsonlResultWriter) Write(e Entry) error {
+	return j.enc.Encode(e)
+}
+
+func (j *jsonlResultWriter) Flush() {
+	if j.flusher != nil {
+		j.flusher.Flush()
+	}
+}
+
+func (j *jsonlResultWriter) Close() error {
+	return nil
+}
+
+// csvResultWriter writes a CSV (or TSV) file with a header row.
+type csvResultWriter struct {
+	cw            *csv.Writer
+	attributes    []string
+	flusher       http.Flusher
+	headerWritten bool
+}
+
+// CSV_COLUMNS are the columns of every CSV and TSV export, followed by any attribute columns.
+var CSV_COLUMNS = []string{"id", "name", "entry_type", "location_abbr", "location_name", "tier", "file", "line"}
+
+func (c *csvResultWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	return c.cw.Write(append(append([]string{}, CSV_COLUMNS...), c.attributes...))
+}
+
+func (c *csvResultWriter) Write(e Entry) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	record := []string{e.ID, e.Name, string(e.Type), "", "", e.Tier, e.File, strconv.Itoa(e.Line)}
+	if e.Location != nil {
+		record[3], record[4] = e.Location.Abbr, e.Location.Name
+	}
+	for _, attr := range c.attributes {
+		record = append(record, e.Attributes[attr])
+	}
+	return c.cw.Write(record)
+}
+
+func (c *csvResultWriter) Flush() {
+	c.cw.Flush()
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+}
+
+func (c *csvResultWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+// AttributeNames returns the attribute columns used by any location for an EntryType, sorted.
+func (ns *NameState) AttributeNames(et EntryType) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, l := range ns.Locations {
+		for _, attr := range l.Attributes[et] {
+			if !seen[attr] {
+				seen[attr] = true
+				names = append(names, attr)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
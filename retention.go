@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	"go.uber.org/zap"
+)
+
+// Ways of anonymizing old analytics
+const (
+	AA_HASH     string = "hash"     // user ids and queries are replaced by salted hashes, so they can still be counted
+	AA_TRUNCATE string = "truncate" // user ids are removed and queries cut to Config.AnalyticsTruncateLength characters
+)
+
+// SQL_ANONYMIZED_PARAMS are the request parameters that identify a user or what they searched for.
+// Only they are anonymized, so the rest of a request can still be reported on.
+const SQL_ANONYMIZED_PARAMS = "('query', 'id')"
+
+// sqlAnonymizeParams returns the SQL setting data_requests.params with each value e of SQL_ANONYMIZED_PARAMS replaced
+// by the SQL expression f. Each parameter is stored as an array of its values (see RequestAnalytic), which is kept.
+func sqlAnonymizeParams(f string) string {
+	return `params = (SELECT jsonb_object_agg(k, CASE WHEN k IN ` + SQL_ANONYMIZED_PARAMS + `
+					THEN COALESCE((SELECT jsonb_agg(` + f + `) FROM jsonb_array_elements_text(params->k) e), '[]'::jsonb)
+					ELSE params->k END) FROM jsonb_object_keys(params) k)`
+}
+
+// RETENTION_TIMEOUT is how long one purge or anonymization pass can take.
+const RETENTION_TIMEOUT = 10 * time.Minute
+
+// RetentionResult is how many rows a purge, anonymization, or deletion changed, by table.
+type RetentionResult map[string]int64
+
+// PurgeAnalytics deletes all analytics recorded before cutoff.
+func (s *Server) PurgeAnalytics(ctx context.Context, cutoff time.Time) (RetentionResult, error) {
+	res := make(RetentionResult)
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		return execAll(ctx, tx, res, []retentionStmt{
+			{"data_search_measurements", `DELETE FROM data_search_measurements m USING data_searches d
+				WHERE m.search_uuid = d.search_uuid AND d.time < $1`},
+			{"data_searches", "DELETE FROM data_searches WHERE time < $1"},
+			{"data_requests", "DELETE FROM data_requests WHERE time < $1"},
+		}, cutoff)
+	})
+	return res, err
+}
+
+// AnonymizeAnalytics anonymizes the user ids and queries of analytics recorded before cutoff, if they haven't been already.
+func (s *Server) AnonymizeAnalytics(ctx context.Context, cutoff time.Time) (RetentionResult, error) {
+	var stmts []retentionStmt
+	args := []interface{}{cutoff}
+	switch s.config.AnalyticsAnonymize {
+	case AA_HASH:
+		// md5(...)::uuid keeps user ids UUIDs, so the same user still has the same id.
+		// Anonymous searches are recorded with the nil UUID, which is left as is so they aren't mistaken for a user.
+		stmts = []retentionStmt{
+			{"data_searches", `UPDATE data_searches SET
+				user_id = CASE WHEN user_id = $3 THEN user_id ELSE md5($2 || user_id::text)::uuid END,
+				query_raw = md5($2 || query_raw),
+				query_processed = md5($2 || query_processed),
+				anonymized = true
+				WHERE time < $1 AND NOT anonymized`},
+			{"data_requests", `UPDATE data_requests SET
+				user_id = CASE WHEN user_id = $3 THEN user_id ELSE md5($2 || user_id::text)::uuid END,
+				` + sqlAnonymizeParams("md5($2 || e)") + `,
+				anonymized = true
+				WHERE time < $1 AND NOT anonymized`},
+		}
+		args = append(args, s.config.AnalyticsSalt, uuid.Nil)
+	case AA_TRUNCATE:
+		stmts = []retentionStmt{
+			{"data_searches", `UPDATE data_searches SET
+				user_id = NULL,
+				query_raw = left(query_raw, $2),
+				query_processed = left(query_processed, $2),
+				anonymized = true
+				WHERE time < $1 AND NOT anonymized`},
+			{"data_requests", `UPDATE data_requests SET
+				user_id = NULL,
+				` + sqlAnonymizeParams("left(e, $2)") + `,
+				anonymized = true
+				WHERE time < $1 AND NOT anonymized`},
+		}
+		args = append(args, s.config.AnalyticsTruncateLength)
+	default:
+		return nil, fmt.Errorf("unknown anonymization method %q", s.config.AnalyticsAnonymize)
+	}
+
+	res := make(RetentionResult)
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		return execAll(ctx, tx, res, stmts, args...)
+	})
+	return res, err
+}
+
+// DeleteUserAnalytics deletes every analytic recorded for a user id.
+// Analytics that have already been anonymized by hashing or truncation no longer have the user's id, so aren't deleted.
+func (s *Server) DeleteUserAnalytics(ctx context.Context, userId uuid.UUID) (RetentionResult, error) {
+	res := make(RetentionResult)
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		return execAll(ctx, tx, res, []retentionStmt{
+			{"data_search_measurements", `DELETE FROM data_search_measurements m USING data_searches d
+				WHERE m.search_uuid = d.search_uuid AND d.user_id = $1`},
+			{"data_searches", "DELETE FROM data_searches WHERE user_id = $1"},
+			{"data_requests", "DELETE FROM data_requests WHERE user_id = $1"},
+		}, userId)
+	})
+	return res, err
+}
+
+type retentionStmt struct {
+	table string
+	sql   string
+}
+
+// execAll runs each statement with the same arguments, adding the rows it affected to res.
+func execAll(ctx context.Context, tx pgx.Tx, res RetentionResult, stmts []retentionStmt, args ...interface{}) error {
+	for _, stmt := range stmts {
+		tag, err := tx.Exec(ctx, stmt.sql, args...)
+		if err != nil {
+			return err
+		}
+		res[stmt.table] += tag.RowsAffected()
+	}
+	return nil
+}
+
+// inTx runs f in a transaction, committing it if f succeeds.
+func (s *Server) inTx(ctx context.Context, f func(tx pgx.Tx) error) error {
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // does nothing once committed
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ApplyRetention purges and anonymizes old analytics, as configured.
+func (s *Server) ApplyRetention() {
+	ctx, cancel := context.WithTimeout(context.Background(), RETENTION_TIMEOUT)
+	defer cancel()
+
+	now := time.Now()
+	if days := s.config.AnalyticsRetentionDays; days > 0 {
+		res, err := s.PurgeAnalytics(ctx, now.AddDate(0, 0, -days))
+		if err != nil {
+			s.logger.Error("error purging analytics", zap.Error(err))
+		} else {
+			s.logger.Info("purged analytics", zap.Int("days", days), zap.Any("deleted", res))
+		}
+	}
+	if days := s.config.AnalyticsAnonymizeDays; days > 0 {
+		res, err := s.AnonymizeAnalytics(ctx, now.AddDate(0, 0, -days))
+		if err != nil {
+			s.logger.Error("error anonymizing analytics", zap.Error(err))
+		} else {
+			s.logger.Info("anonymized analytics", zap.Int("days", days), zap.String("method", s.config.AnalyticsAnonymize), zap.Any("updated", res))
+		}
+	}
+	s.reports.Clear()
+}
+
+// RetainAnalytics applies the retention settings now and then every Config.RetentionInterval.
+// It never returns, so should be run in its own goroutine.
+func (s *Server) RetainAnalytics() {
+	if s.config.AnalyticsAnonymizeDays > 0 && s.config.AnalyticsAnonymize == AA_HASH && s.config.AnalyticsSalt == "" {
+		s.logger.Warn("anonymizing analytics without ANALYTICS_SALT, so hashed queries can be guessed")
+	}
+	s.ApplyRetention()
+	ticker := time.NewTicker(s.config.RetentionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.ApplyRetention()
+	}
+}
+
+// UserDeletion is the response to a deletion request.
+type UserDeletion struct {
+	UserId  uuid.UUID       `json:"user_id"`
+	Deleted RetentionResult `json:"deleted"` // rows, by table, and "spill" for spilled analytics
+	Total   int64           `json:"total"`
+}
+
+// DeleteUserAnalyticsHandler deletes every analytic of the user in the 'user_id' parameter, from the database and the spill file.
+// Analytics still queued or in the file sinks aren't deleted.
+func (s *Server) DeleteUserAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	RedactRequestParams(r) // don't record the user id again
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(MarshalError("delete with POST or DELETE"))
+		return
+	}
+
+	userId, err := uuid.FromString(r.URL.Query().Get("user_id"))
+	if err != nil || userId == uuid.Nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid 'user_id' parameter provided. Should be a UUID"))
+		return
+	}
+
+	res, err := s.DeleteUserAnalytics(r.Context(), userId)
+	if err != nil {
+		s.logger.Error("error deleting user analytics", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	s.reports.Clear()
+
+	spilled, err := s.analytics.DeleteSpilled(userId)
+	if err != nil {
+		// The database rows are gone, but spilled ones would come back when replayed
+		s.logger.Error("error deleting spilled user analytics", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	res["spill"] = int64(spilled)
+
+	deletion := UserDeletion{UserId: userId, Deleted: res}
+	for _, n := range res {
+		deletion.Total += n
+	}
+	s.logger.Info("deleted user analytics", zap.Int64("total", deletion.Total))
+
+	enc, err := json.Marshal(deletion)
+	if err != nil {
+		s.logger.DPanic("error encoding user deletion", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(enc)
+}
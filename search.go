@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"log"
 	"os/exec"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -32,6 +34,20 @@ func NewSearchType(s string) (SearchType, bool) {
 	}
 }
 
+// String returns the name of a SearchType, as used in the 'type' parameter.
+func (st SearchType) String() string {
+	switch st {
+	case ST_SPECIFIC:
+		return "specific"
+	case ST_FALLBACK:
+		return "fallback"
+	case ST_EXTENDED:
+		return "extended"
+	default:
+		return ""
+	}
+}
+
 // NUM_RESULTS is the maximum number of search results to return.
 const NUM_RESULTS int = 100
 
@@ -59,13 +75,13 @@ func (sq SearchQuery) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 
 // NewSearchQuery creates a new search query from strings.
 // It validates the type, location, and query before returning the new SearchQuery.
-func (s *Server) NewSearchQuery(query, locationAbbr, entryType string) (SearchQuery, string) {
+func (s *Server) NewSearchQuery(ns *NameState, query, locationAbbr, entryType string) (SearchQuery, string) {
 	et, ok := NewEntryType(entryType)
 	if !ok {
 		s.logger.Error("invalid entryType", zap.String(ZAP_ENTRY_TYPE, entryType))
 		return SearchQuery{}, RS_INVALID_TYPE
 	}
-	location, ok := s.LookupLocationByAbbr(locationAbbr)
+	location, ok := ns.LookupLocationByAbbr(locationAbbr)
 	if !ok {
 		s.logger.Error("invalid locationAbbr", zap.String(ZAP_LOCATION_ABBR, locationAbbr))
 		return SearchQuery{}, RS_INVALID_LOCATION
@@ -81,120 +97,295 @@ func (s *Server) NewSearchQuery(query, locationAbbr, entryType string) (SearchQu
 	return b, ""
 }
 
-func (s *Server) FormatSearch(query string) string {
-	// Replacements
-	current := s.DoReplacements(query)
-	return current
+// SearchStep is a single change made to a query by FormatSearch, as shown by /explain.
+type SearchStep struct {
+	Stage  string `json:"stage"`
+	RuleID int    `json:"rule_id,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Val    string `json:"val,omitempty"`
+	Before string `json:"before"`
+	After  string `json:"after"`
 }
 
-// IndividualSearch runs a specific (1 location) search.
-func (s *Server) IndividualSearch(query string, loc *Location, typ EntryType, num int) ([]Entry, bool) {
-	fileName := FileName(loc, typ)
-	folder := filepath.Join(NAME_FOLDER, loc.Folder(), fileName)
+// FormatSearch turns a raw query into the regular expression that is actually searched for a location and entry type.
+// If the query was transliterated, the variants (including the original) are returned too, so it's possible to tell which one matched.
+// It fails if the query's macros can't be expanded.
+func (s *Server) FormatSearch(query string, loc *Location, et EntryType) (string, []QueryVariant, error) {
+	return s.formatSearch(query, loc, et, nil)
+}
 
-	// Check for existence of file first
-	if !FileExists(folder) {
-		s.logger.Info("file doesn't exist", zap.String(ZAP_PATH, folder))
-		return []Entry{}, true // No results, but not a user error
+// formatSearch is FormatSearch, appending each change it makes to steps if it isn't nil.
+func (s *Server) formatSearch(query string, loc *Location, et EntryType, steps *[]SearchStep) (string, []QueryVariant, error) {
+	// Macros. Their places are held until after the replacements, which shouldn't change them.
+	held, macros, err := HoldMacros(query, s.cachedMacros)
+	if err != nil {
+		return "", nil, err
 	}
+	expanded := macros.Release(held)
+	if steps != nil && expanded != query {
+		*steps = append(*steps, SearchStep{Stage: "macros", Before: query, After: expanded})
+	}
+	script := QueryScript(expanded)
 
-	cmd := exec.Command("rg", "--crlf", "-i", "-m", strconv.Itoa(num), query, folder)
+	variants := []QueryVariant{{Script: script, Query: held}}
+	variantMacros := []HeldMacros{macros}
 
-	out, err := cmd.Output()
-	if err != nil {
-		// Error with running rg
-		if err.Error() == "exit status 1" {
-			// No results
-			return []Entry{}, true
-		} else if err.Error() == "exit status 2" {
-			// Invalid query (like just a single "[")
-			s.logger.Warn("invalid query", zap.String("query", query))
-			return []Entry{}, false
-		} else {
-			s.logger.Error("error running rg", zap.Error(err))
-			return []Entry{}, false
+	// Transliteration, of the query and its macros
+	if s.config.Transliterate {
+		for _, to := range loc.AllScripts() {
+			if to == script {
+				continue
+			}
+			v := QueryVariant{Script: to, Query: transliterateTo(loc, held, to)}
+			vm := make(HeldMacros, len(macros))
+			for i, m := range macros {
+				vm[i] = HeldMacro{Name: m.Name, Expanded: transliterateTo(loc, m.Expanded, to)}
+			}
+			after := vm.Release(v.Query)
+			if after == expanded {
+				continue
+			}
+			if steps != nil {
+				*steps = append(*steps, SearchStep{Stage: "transliteration", Val: string(v.Script), Before: expanded, After: after})
+			}
+			variants = append(variants, v)
+			variantMacros = append(variantMacros, vm)
 		}
-	} else {
-		entries := []Entry{}
-		trimmed := strings.TrimSuffix(string(out), "\n")
-		lines := strings.Split(trimmed, "\n")
-		for _, l := range lines {
-			entries = append(entries, Entry{
-				Name:     l,
-				Type:     typ,
-				Location: loc,
-			})
+	}
+
+	// Replacements, then the macros are put back
+	for i := range variants {
+		first := 0
+		if steps != nil {
+			first = len(*steps)
 		}
-		return entries, true
+		variants[i].Query = variantMacros[i].Release(s.DoReplacements(variants[i].Query, loc, et, steps))
+		if steps != nil {
+			for j := first; j < len(*steps); j++ {
+				(*steps)[j].Before, (*steps)[j].After = variantMacros[i].Show((*steps)[j].Before), variantMacros[i].Show((*steps)[j].After)
+			}
+		}
+	}
+	if len(variants) == 1 {
+		return variants[0].Query, nil, nil
 	}
+
+	parts := []string{}
+	for i, v := range variants {
+		parts = append(parts, "(?:"+v.Query+")")
+		variants[i].re, _ = CompileQuery(v.Query)
+	}
+	return strings.Join(parts, "|"), variants, nil
 }
 
-// ExtendedSearch runs a broader (all locations, but same EntryType) search.
-func (s *Server) ExtendedSearch(query string, loc *Location, typ EntryType, numResults int) ([]Entry, bool) {
-	excludeLocations := append(loc.RelatedIds, loc.ID) // don't return results for that specific country or related
+// transliterateTo returns the form of a query (or part of one) in a Script.
+// It's returned unchanged if it's already written in that Script, or has no letters to transliterate.
+func transliterateTo(loc *Location, q string, to Script) string {
+	for _, v := range loc.Transliterate(q) {
+		if v.Script == to {
+			return v.Query
+		}
+	}
+	return q
+}
+
+// EntryFunc is called with each entry a search finds, as it finds it. Returning false stops the search.
+type EntryFunc func(e Entry) bool
+
+// IndividualSearch runs a specific (1 location) search, passing each entry to found. It returns how many were found.
+// Unless allColumns is set, only the name column of files with attribute columns is matched.
+// If ctx is done, it stops without reporting an invalid query, so callers should check ctx.Err().
+func (s *Server) IndividualSearch(ctx context.Context, ns *NameState, query string, loc *Location, typ EntryType, num int, allColumns bool, found EntryFunc) (int, bool) {
+	if loc.HasAttributes(typ) && !allColumns {
+		return s.NativeSearch(ctx, ns, query, loc, typ, num, found)
+	}
 
-	typeGlob := "**/*" + string(typ) + ".txt" // N, O, P
-	cmd := exec.Command("rg", "--crlf", "-i", "--glob", typeGlob, "-m", strconv.Itoa(numResults), query, NAME_FOLDER)
+	// Check for existence of file first
+	nameFolder := ns.Folder
+	folder, ok := NameFilePath(nameFolder, loc, typ)
+	if !ok {
+		s.logger.Info("file doesn't exist", zap.String(ZAP_PATH, folder))
+		return 0, true // No results, but not a user error
+	}
+
+	args := []string{"--crlf", "-i", "-n", "-m", strconv.Itoa(num)}
+	if IsCompressed(folder) {
+		args = append(args, "--search-zip")
+	}
+
+	rel := RelativeNamePath(nameFolder, folder)
+	numFound := 0
+	ok = s.runRipgrep(ctx, append(args, query, folder), query, func(l string) bool {
+		parts := strings.SplitN(l, ":", 2) // [0] is the line number
+		if len(parts) != 2 {
+			return true
+		}
+		lineNum, _ := strconv.Atoi(parts[0])
+		numFound++
+		return found(loc.NewEntry(parts[1], typ, rel, lineNum))
+	})
+	return numFound, ok
+}
 
-	out, err := cmd.Output()
+// runRipgrep runs rg with args, passing each line of its output to line as it's read, until line returns false.
+// Only one line is held in memory at a time. It returns false if the query was invalid, or rg couldn't be run;
+// stopping early, or ctx being done, aren't errors.
+func (s *Server) runRipgrep(ctx context.Context, args []string, query string, line func(l string) bool) bool {
+	rgCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(rgCtx, "rg", args...)
+	out, err := cmd.StdoutPipe()
 	if err != nil {
-		// Error with running rg
-		if err.Error() == "exit status 1" {
-			// No results
-			return []Entry{}, true
-		} else if err.Error() == "exit status 2" {
-			// Invalid query (like just a single "[")
-			s.logger.Warn("invalid query", zap.String("query", query))
-			return []Entry{}, false
-		} else {
-			log.Print(err)
-			return []Entry{}, false
+		s.logger.Error("error running rg", zap.Error(err))
+		return false
+	}
+	if err := cmd.Start(); err != nil {
+		s.logger.Error("error running rg", zap.Error(err))
+		return false
+	}
+
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LINE_LENGTH+4096) // the line, with its path and line number
+	stopped := false
+	for scanner.Scan() {
+		if !line(scanner.Text()) {
+			stopped = true
+			break
 		}
-	} else {
+	}
+	scanErr := scanner.Err()
+	cancel() // stops rg if it's still writing
+	err = cmd.Wait()
 
-		trimmed := strings.TrimSuffix(string(out), "\n")
-		lines := strings.Split(trimmed, "\n")
-		entries := []Entry{}
+	switch {
+	case scanErr != nil:
+		s.logger.Error("error reading rg output", zap.Error(scanErr))
+		return false
+	case err == nil, stopped:
+		return true
+	case ctx.Err() != nil:
+		// Cancelled or timed out, which the caller checks for
+		return true
+	case err.Error() == "exit status 1":
+		// No results
+		return true
+	case err.Error() == "exit status 2":
+		// Invalid query (like just a single "[")
+		s.logger.Warn("invalid query", zap.String("query", query))
+		return false
+	default:
+		s.logger.Error("error running rg", zap.Error(err))
+		return false
+	}
+}
 
-		for _, l := range lines {
-			if len(entries) == numResults { // Is this the most efficient way?
-				break
-			}
-			parts := strings.Split(l, ":") // [0] is path
-			locationFolder := filepath.Base(filepath.Dir(parts[0]))
-			locationAbbr := strings.Split(locationFolder, " ")[0]
-			location, ok := s.LookupLocationByAbbr(locationAbbr)
-			if !ok {
-				// Invalid location
-				s.logger.Warn("invalid location ", zap.String(ZAP_LOCATION_ABBR, locationAbbr))
-				continue
-			}
+// ExtendedLocations returns the locations an extended search from loc covers: every location with a name file of the
+// entry type, other than loc and its related locations, sorted by abbreviation.
+func (ns *NameState) ExtendedLocations(loc *Location, typ EntryType) []*Location {
+	exclude := map[int]bool{loc.ID: true} // searched by the specific and fallback tiers
+	for _, id := range loc.RelatedIds {
+		exclude[id] = true
+	}
+	locations := []*Location{}
+	for _, l := range ns.Locations {
+		if exclude[l.ID] {
+			continue
+		}
+		if _, ok := NameFilePath(ns.Folder, l, typ); ok {
+			locations = append(locations, l)
+		}
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].Abbr < locations[j].Abbr })
+	return locations
+}
 
-			ok = true
+// extendedFiles splits the locations an extended search covers into the name files rg can search, by path, and the
+// locations with attribute columns, which are searched natively so that only their names are matched.
+// rg is given each path rather than globbing the names folder, so it only reads the file NameFilePath chose for
+// a location, even if it has both a plain and a compressed one.
+func extendedFiles(ns *NameState, loc *Location, typ EntryType, allColumns bool) (map[string]*Location, []*Location) {
+	plain := make(map[string]*Location)
+	native := []*Location{}
+	for _, l := range ns.ExtendedLocations(loc, typ) {
+		if l.HasAttributes(typ) && !allColumns {
+			native = append(native, l)
+			continue
+		}
+		path, _ := NameFilePath(ns.Folder, l, typ)
+		plain[path] = l
+	}
+	return plain, native
+}
 
-			for _, curID := range excludeLocations {
-				if location.ID == curID {
-					// current entry ID matches an exclusion
-					ok = false
-					break
-				}
-			}
+// extendedArgs returns the arguments rg needs to search the plain files of an extended search, other than the
+// patterns and paths. Each result is prefixed by its path and a NUL, so paths can have any characters.
+func extendedArgs(plain map[string]*Location) ([]string, []string) {
+	paths := make([]string, 0, len(plain))
+	for path := range plain {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return []string{"--crlf", "-i", "-n", "--with-filename", "--null", "--search-zip"}, paths
+}
 
-			if !ok {
-				continue
-			}
+// parseExtendedLine turns a line of rg's output from an extended search into an entry, also returning the line of the
+// name file it came from.
+func parseExtendedLine(ns *NameState, plain map[string]*Location, typ EntryType, l string) (Entry, string, bool) {
+	i := strings.IndexByte(l, 0)
+	if i == -1 {
+		return Entry{}, "", false
+	}
+	path := l[:i]
+	location, ok := plain[path]
+	if !ok {
+		return Entry{}, "", false
+	}
+	parts := strings.SplitN(l[i+1:], ":", 2) // [0] is the line number
+	if len(parts) != 2 {
+		return Entry{}, "", false
+	}
+	lineNum, _ := strconv.Atoi(parts[0])
+	return location.NewEntry(parts[1], typ, RelativeNamePath(ns.Folder, path), lineNum), parts[1], true
+}
 
-			name := strings.Join(parts[1:], ":")
+// ExtendedSearch runs a broader (all locations, but same EntryType) search, passing each entry to found. It returns how many were found.
+// Unless allColumns is set, only the name column of files with attribute columns is matched.
+// Like IndividualSearch, callers should check ctx.Err().
+func (s *Server) ExtendedSearch(ctx context.Context, ns *NameState, query string, loc *Location, typ EntryType, numResults int, allColumns bool, found EntryFunc) (int, bool) {
+	plain, native := extendedFiles(ns, loc, typ, allColumns)
 
-			entries = append(entries, Entry{
-				Name:     name,
-				Type:     typ,
-				Location: location,
-			})
+	numFound := 0
+	stopped := false // by found
+	add := func(e Entry) bool {
+		numFound++
+		if !found(e) {
+			stopped = true
+			return false
+		}
+		return numFound < numResults
+	}
+
+	ok := true
+	if len(plain) > 0 {
+		args, paths := extendedArgs(plain)
+		args = append(args, "-m", strconv.Itoa(numResults), "-e", query)
+		ok = s.runRipgrep(ctx, append(args, paths...), query, func(l string) bool {
+			e, _, ok := parseExtendedLine(ns, plain, typ, l)
+			if !ok {
+				return true
+			}
+			return add(e)
+		})
+	}
+	// rg's -m would count lines matching only in an attribute column, so these are searched separately
+	for _, l := range native {
+		if !ok || stopped || numFound >= numResults || ctx.Err() != nil {
+			break
 		}
-		s.logger.Debug("extended search returning results",
-			zap.Int(ZAP_NUM_RESULTS, len(entries)),
-			zap.String("query", query))
-		return entries, true
+		_, ok = s.NativeSearch(ctx, ns, query, l, typ, numResults-numFound, add)
 	}
+	s.logger.Debug("extended search returning results",
+		zap.Int(ZAP_NUM_RESULTS, numFound),
+		zap.String("query", query))
+	return numFound, ok
 }
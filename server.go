@@ -3,6 +3,12 @@ package main
 import (
 	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/jackc/pgtype"
 	pgtypeuuid "github.com/jackc/pgtype/ext/gofrs-uuid"
@@ -19,8 +25,8 @@ const (
 )
 
 type Server struct {
-	// env variable
-	dbString string
+	// env variables
+	config Config
 
 	logger *zap.Logger
 
@@ -28,42 +34,107 @@ type Server struct {
 
 	conn *pgxpool.Pool
 
-	locations map[int]*Location // id -> location
+	// The active names folder, its locations, and everything else derived from the name files
+	nameState  atomic.Value // *NameState, see Names
+	generation uint64       // of the last NameState published, guarded by refreshMux
 
 	// This is what is cached and needs to be refreshed when updated through Directus
-	cachedLocations    []byte            // JSON encoded list of locations, in order to avoid having to reparse again and again
-	cachedReplacements map[string]string // key -> val
-	cachedCouldBes     map[string]string // key -> val
-	cachedMessage      []byte
-
-	// For counts
-	fileLengths  map[EntryType]map[int]int64 // fileLengths[EntryType][Location.Id] = length
-	totalLengths map[EntryType]int64
+	cachedReplacements  []Replacement // in the order they are applied
+	invalidReplacements []InvalidRule
+	cachedMacros        map[string]Macro // name -> macro
+	invalidMacros       []InvalidRule
+	cachedCouldBes      []CouldBe // in the order they are returned
+	couldBeMatcher      *AhoCorasick
+	invalidCouldBes     []InvalidRule
+	cachedMessage       []byte
+
+	// For diffs
+	diffMux    sync.RWMutex         // guards fileDiffs and the snapshots they were read from
+	fileDiffs  map[string]FileDiff  // the most recent change to each name file, by diffKey (only the counts)
+	diffStamps map[string]fileState // the state of each name file when it was last compared
+
+	refreshMux sync.Mutex // only one refresh (full or partial) at a time
+
+	analytics *AnalyticsWriter
+	reports   *ReportCache
 }
 
 // NewServer creates a new Server.
-func NewServer(dbString string, logger *zap.Logger) *Server {
-	s := Server{dbString: dbString, logger: logger}
+func NewServer(config Config, logger *zap.Logger) *Server {
+	s := Server{config: config, logger: logger, reports: NewReportCache(config.ReportCacheTTL)}
+
+	nameFolder, err := ActiveNameFolder()
+	if err != nil {
+		logger.Panic("error finding active names folder", zap.Error(err))
+	}
+	s.PublishNames(&NameState{Folder: nameFolder}) // loaded by Refresh
 
 	s.InstallDB()
+	s.InstallAnalytics()
 	s.InstallHTTP()
 	s.Refresh() // Install refreshable things
+	if config.WatchNames {
+		go s.WatchNames()
+	}
+	if config.AnalyticsRetentionDays > 0 || config.AnalyticsAnonymizeDays > 0 {
+		go s.RetainAnalytics()
+	}
 	return &s
 }
 
 func (s *Server) Refresh() {
+	s.refreshMux.Lock()
+	defer s.refreshMux.Unlock()
+
 	s.logger.Info("starting refresh")
-	s.InstallLocations()
-	s.InstallFileLengths() // Needs to be after InstallLocations
+	s.InstallNames()
+	ns := s.Names()
+	s.UpdateDiffs(ns.Folder, LocationList(ns.Locations))
 	s.InstallReplacements()
+	s.InstallMacros()
 	s.InstallCouldBes()
 	s.InstallMessage()
 	s.logger.Info("refreshed")
 }
 
-// Run starts the Server.
+// RefreshLocations refreshes only the state derived from the name files of the given locations.
+func (s *Server) RefreshLocations(locs []*Location) {
+	s.refreshMux.Lock()
+	defer s.refreshMux.Unlock()
+
+	ns := s.Names().Copy()
+	s.UpdateFileLengths(ns, locs)
+	s.UpdateAutocomplete(ns, locs)
+	s.PublishNames(ns)
+	s.UpdateDiffs(ns.Folder, locs)
+	s.logger.Info("refreshed locations", zap.Int("num", len(locs)))
+}
+
+// Run starts the Server. On SIGINT or SIGTERM, it finishes the requests in progress and writes any queued analytics before returning.
 func (s *Server) Run() {
-	s.logger.Fatal("server error", zap.Error(http.ListenAndServe(LISTEN_ADDR, s.httpHandler)))
+	srv := &http.Server{Addr: LISTEN_ADDR, Handler: s.httpHandler}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		s.logger.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			s.logger.Error("error shutting down", zap.Error(err))
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		s.logger.Fatal("server error", zap.Error(err))
+	}
+	<-shutdown
+	s.analytics.Close()
+	s.logger.Info("stopped")
 }
 
 func (s *Server) InstallHTTP() {
@@ -72,17 +143,41 @@ func (s *Server) InstallHTTP() {
 	mux.HandleFunc("/", s.RootHandler)
 	mux.HandleFunc("/locations", s.LocationsHandler)
 	mux.HandleFunc("/search", s.SearchHandler)
+	mux.HandleFunc("/search/batch", s.BatchSearchHandler)
 	mux.HandleFunc("/counts", s.CountsHandler)
+	mux.HandleFunc("/counts/all", s.CountsAllHandler)
 	mux.HandleFunc("/message", s.MessageHandler)
 	mux.HandleFunc("/couldbes", s.CouldBesHandler)
+	mux.HandleFunc("/explain", s.ExplainHandler)
+	mux.HandleFunc("/autocomplete", s.AutocompleteHandler)
+	mux.HandleFunc("/macros", s.MacrosHandler)
 	mux.HandleFunc("/refresh", s.RefreshHandler)
+
+	// Admin
+	mux.HandleFunc("/upload", s.RequireAuth(s.UploadHandler))
+	mux.HandleFunc("/admin/lint", s.RequireAuth(s.LintHandler))
+	mux.HandleFunc("/admin/versions", s.RequireAuth(s.VersionsHandler))
+	mux.HandleFunc("/admin/versions/activate", s.RequireAuth(s.ActivateVersionHandler))
+	mux.HandleFunc("/admin/versions/rollback", s.RequireAuth(s.RollbackVersionHandler))
+	mux.HandleFunc("/admin/diff", s.RequireAuth(s.DiffHandler))
+	mux.HandleFunc("/admin/analytics/stats", s.RequireAuth(s.AnalyticsStatsHandler))
+	mux.HandleFunc("/admin/analytics/users", s.RequireAuth(s.DeleteUserAnalyticsHandler))
+	mux.HandleFunc("/admin/mine", s.RequireAuth(s.MineHandler))
+
+	// Analytics reports
+	mux.HandleFunc("/analytics/top-queries", s.RequireAuth(s.ReportHandler(s.TopQueriesReport)))
+	mux.HandleFunc("/analytics/zero-results", s.RequireAuth(s.ReportHandler(s.ZeroResultsReport)))
+	mux.HandleFunc("/analytics/errors", s.RequireAuth(s.ReportHandler(s.ErrorsReport)))
+	mux.HandleFunc("/analytics/latency", s.RequireAuth(s.ReportHandler(s.LatencyReport)))
+	mux.HandleFunc("/analytics/users", s.RequireAuth(s.ReportHandler(s.UsersReport)))
+	mux.HandleFunc("/analytics/timeline", s.RequireAuth(s.ReportHandler(s.TimelineReport)))
 	c := cors.AllowAll()
 
-	s.httpHandler = c.Handler(mux)
+	s.httpHandler = c.Handler(s.RecordRequests(mux))
 }
 
 func (s *Server) InstallDB() {
-	dbConfig, err := pgxpool.ParseConfig(s.dbString)
+	dbConfig, err := pgxpool.ParseConfig(s.config.DBString)
 	if err != nil {
 		s.logger.Panic("error creating db config", zap.Error(err))
 	}
@@ -96,7 +191,7 @@ func (s *Server) InstallDB() {
 		return nil
 	}
 
-	conn, err := pgxpool.Connect(context.Background(), s.dbString)
+	conn, err := pgxpool.Connect(context.Background(), s.config.DBString)
 	if err != nil {
 		s.logger.Panic("Couldn't connect to database")
 	}
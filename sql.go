@@ -12,12 +12,29 @@ CREATE TABLE IF NOT EXISTS could_bes (
 	val TEXT
 );
 
+ALTER TABLE could_bes ADD COLUMN IF NOT EXISTS category TEXT;
+ALTER TABLE could_bes ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE could_bes ADD COLUMN IF NOT EXISTS locations TEXT; -- comma-separated abbreviations, NULL for every location
+ALTER TABLE could_bes ADD COLUMN IF NOT EXISTS entry_types TEXT; -- comma-separated, like 'N,P', NULL for every entry type
+
 CREATE TABLE IF NOT EXISTS replacements (
 	id SERIAL PRIMARY KEY,
 	key TEXT NOT NULL,
 	val TEXT
 );
 
+ALTER TABLE replacements ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE replacements ADD COLUMN IF NOT EXISTS is_regex BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE replacements ADD COLUMN IF NOT EXISTS locations TEXT; -- comma-separated abbreviations, NULL for every location
+ALTER TABLE replacements ADD COLUMN IF NOT EXISTS entry_types TEXT; -- comma-separated, like 'N,P', NULL for every entry type
+
+CREATE TABLE IF NOT EXISTS macros (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL, -- used as {name} in queries
+	val TEXT NOT NULL,
+	description TEXT
+);
+
 CREATE TABLE IF NOT EXISTS locations (
 	id SERIAL PRIMARY KEY,
 	abbr TEXT NOT NULL,
@@ -25,6 +42,16 @@ CREATE TABLE IF NOT EXISTS locations (
 	is_language BOOLEAN NOT NULL
 );
 
+ALTER TABLE locations ADD COLUMN IF NOT EXISTS scripts TEXT; -- comma-separated, like 'cyrillic,latin', NULL for latin
+
+CREATE TABLE IF NOT EXISTS transliterations (
+	id SERIAL PRIMARY KEY,
+	location_id INTEGER REFERENCES locations, -- NULL to change the default for every location
+	script TEXT NOT NULL,
+	native TEXT NOT NULL, -- a single letter, or '' for Latin letters that may be left out
+	latin TEXT NOT NULL -- comma-separated, the first is preferred
+);
+
 CREATE TABLE IF NOT EXISTS related_locations (
 	id SERIAL PRIMARY KEY,
 	location_id INTEGER REFERENCES locations,
@@ -33,6 +60,14 @@ CREATE TABLE IF NOT EXISTS related_locations (
 	UNIQUE(location_id, related_id)
 );
 
+CREATE TABLE IF NOT EXISTS location_attributes (
+	id SERIAL PRIMARY KEY,
+	location_id INTEGER REFERENCES locations,
+	entry_type CHAR, -- NULL for every entry type
+	name TEXT NOT NULL,
+	sort INTEGER
+);
+
 CREATE TABLE IF NOT EXISTS data_searches (
 	id BIGSERIAL PRIMARY KEY,
 	user_id UUID,
@@ -46,4 +81,45 @@ CREATE TABLE IF NOT EXISTS data_searches (
 	query_location INTEGER REFERENCES locations,
 	query_type CHAR
 );
+
+ALTER TABLE data_searches ADD COLUMN IF NOT EXISTS variants_matched TEXT; -- comma-separated scripts of the transliterated variants that matched
+ALTER TABLE data_searches ADD COLUMN IF NOT EXISTS search_uuid UUID;
+ALTER TABLE data_searches ADD COLUMN IF NOT EXISTS suggested BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE data_searches ADD COLUMN IF NOT EXISTS from_suggestion UUID; -- the search_uuid of the search whose suggestion was followed
+
+ALTER TABLE data_searches ADD COLUMN IF NOT EXISTS anonymized BOOLEAN NOT NULL DEFAULT false; -- see AnonymizeAnalytics
+
+CREATE INDEX IF NOT EXISTS data_searches_time ON data_searches (time);
+CREATE INDEX IF NOT EXISTS data_searches_user ON data_searches (user_id);
+CREATE INDEX IF NOT EXISTS data_searches_search ON data_searches (search_uuid); -- joined to data_search_measurements
+
+CREATE TABLE IF NOT EXISTS data_search_measurements (
+	id BIGSERIAL PRIMARY KEY,
+	search_uuid UUID NOT NULL, -- data_searches.search_uuid
+	search_type INTEGER,
+	location_id INTEGER REFERENCES locations, -- NULL for extended searches, which search every location
+	num_returned INTEGER,
+	duration INTEGER, -- ms
+	cancelled BOOLEAN NOT NULL DEFAULT false,
+	timed_out BOOLEAN NOT NULL DEFAULT false
+);
+CREATE INDEX IF NOT EXISTS data_search_measurements_search ON data_search_measurements (search_uuid);
+
+CREATE TABLE IF NOT EXISTS data_requests (
+	id BIGSERIAL PRIMARY KEY,
+	time TIMESTAMP,
+	endpoint TEXT, -- the route, not the path
+	method TEXT,
+	params JSONB, -- the query parameters
+	user_id UUID,
+	status INTEGER,
+	duration INTEGER, -- ms
+	bytes BIGINT,
+	detail TEXT -- set by some handlers: the search_uuid for /search, the could_be ids shown by /couldbes
+);
+ALTER TABLE data_requests ADD COLUMN IF NOT EXISTS anonymized BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS data_requests_time ON data_requests (time);
+CREATE INDEX IF NOT EXISTS data_requests_user ON data_requests (user_id);
+CREATE INDEX IF NOT EXISTS data_requests_endpoint ON data_requests (endpoint, time);
 `
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// NUM_SUGGESTIONS is the most names, and the most locations, suggested for a search.
+	NUM_SUGGESTIONS int = 5
+	// MAX_SUGGEST_FILE_SIZE is the largest name file (uncompressed, in bytes) that is read to suggest names.
+	MAX_SUGGEST_FILE_SIZE int64 = 256 << 20
+	// SUGGEST_TIMEOUT is how long finding suggestions can take, after which the closest names so far are suggested.
+	SUGGEST_TIMEOUT = 5 * time.Second
+	// MAX_SUGGEST_MATCHES is the most matches counted in each location suggested, after which it stops reading its file.
+	MAX_SUGGEST_MATCHES int = 1000
+)
+
+// Suggestions are offered when a search has no results.
+type Suggestions struct {
+	Names     []NameSuggestion     `json:"names"`     // the closest names in the searched location
+	Locations []LocationSuggestion `json:"locations"` // other locations where the query does match
+}
+
+// NameSuggestion is a name that is close to the query.
+type NameSuggestion struct {
+	Name     string `json:"name"`
+	Distance int    `json:"distance"` // edit distance from the query
+	Phonetic bool   `json:"phonetic"` // sounds like the query
+}
+
+// LocationSuggestion is a location where the query matches.
+type LocationSuggestion struct {
+	Location   *Location `json:"location"`
+	NumMatches int       `json:"num_matches"` // at most MAX_SUGGEST_MATCHES
+}
+
+// Suggest finds suggestions for a search with no results. rawQuery is the query as it was typed, and query is what was searched.
+// It takes at most SUGGEST_TIMEOUT (or until ctx is done), returning what it has found so far.
+func (s *Server) Suggest(ctx context.Context, ns *NameState, rawQuery, query string, loc *Location, typ EntryType) *Suggestions {
+	ctx, cancel := context.WithTimeout(ctx, SUGGEST_TIMEOUT)
+	defer cancel()
+	return &Suggestions{
+		Names:     s.SuggestNames(ctx, ns, rawQuery, loc, typ),
+		Locations: s.SuggestLocations(ctx, ns, query, loc, typ),
+	}
+}
+
+// QueryLiteral returns the literal text of a query, without any regular expression syntax, in lower case.
+func QueryLiteral(q string) string {
+	var b strings.Builder
+	MapLiterals(q, func(lit string) string {
+		b.WriteString(lit)
+		return lit
+	})
+	return strings.ToLower(strings.TrimSpace(b.String()))
+}
+
+// maxSuggestDistance is how different a name can be from a query of length n and still be suggested.
+func maxSuggestDistance(n int) int {
+	switch {
+	case n <= 4:
+		return 1
+	case n <= 8:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// nameSuggester keeps the names closest to a query, as each name of a file is given to it.
+type nameSuggester struct {
+	lit         []rune
+	maxDistance int
+	soundex     string
+	seen        map[string]bool
+	suggestions []NameSuggestion
+}
+
+// newNameSuggester returns a nameSuggester for a query, or nil if it has no literal text to compare names with.
+func newNameSuggester(rawQuery string) *nameSuggester {
+	lit := []rune(QueryLiteral(rawQuery))
+	if len(lit) == 0 {
+		return nil
+	}
+	return &nameSuggester{
+		lit:         lit,
+		maxDistance: maxSuggestDistance(len(lit)),
+		soundex:     Soundex(string(lit)),
+		seen:        make(map[string]bool),
+		suggestions: []NameSuggestion{},
+	}
+}
+
+// Add considers a name, keeping it if it's one of the NUM_SUGGESTIONS closest so far.
+func (sg *nameSuggester) Add(name string) {
+	lower := strings.ToLower(name)
+	if sg.seen[lower] {
+		return
+	}
+
+	// Compare against the whole name and each of its words
+	cand := NameSuggestion{Name: name, Distance: sg.maxDistance + 1}
+	for _, candidate := range append([]string{lower}, strings.Fields(lower)...) {
+		if d := EditDistance(sg.lit, []rune(candidate), sg.maxDistance); d < cand.Distance {
+			cand.Distance = d
+		}
+		if sg.soundex != "" && Soundex(candidate) == sg.soundex {
+			cand.Phonetic = true
+		}
+	}
+	if cand.Distance > sg.maxDistance && !cand.Phonetic {
+		return
+	}
+	sg.seen[lower] = true
+
+	i := sort.Search(len(sg.suggestions), func(i int) bool { return betterSuggestion(cand, sg.suggestions[i]) })
+	if i < NUM_SUGGESTIONS {
+		sg.suggestions = append(sg.suggestions, NameSuggestion{})
+		copy(sg.suggestions[i+1:], sg.suggestions[i:])
+		sg.suggestions[i] = cand
+		if len(sg.suggestions) > NUM_SUGGESTIONS {
+			sg.suggestions = sg.suggestions[:NUM_SUGGESTIONS]
+		}
+	}
+}
+
+// suggestFilePath returns the path of the name file to suggest names from, or false if it doesn't exist or is too large.
+// Compressed files are only known to be too large once they're read, see limitSuggestFile.
+func suggestFilePath(ns *NameState, loc *Location, typ EntryType) (string, bool) {
+	if ns.FileLengths[typ][loc.ID] > MAX_SUGGEST_FILE_SIZE { // on disk, so never more than uncompressed
+		return "", false
+	}
+	return NameFilePath(ns.Folder, loc, typ)
+}
+
+// limitSuggestFile limits reading a name file to MAX_SUGGEST_FILE_SIZE uncompressed bytes.
+// If N is 0 once the file has been read, it was too large.
+func limitSuggestFile(f io.Reader) *io.LimitedReader {
+	return &io.LimitedReader{R: f, N: MAX_SUGGEST_FILE_SIZE + 1}
+}
+
+// SuggestNames returns the names in a location's name file closest to the query, by edit distance or by sounding the same.
+// If ctx is done, it stops reading and returns the closest so far.
+func (s *Server) SuggestNames(ctx context.Context, ns *NameState, rawQuery string, loc *Location, typ EntryType) []NameSuggestion {
+	sg := newNameSuggester(rawQuery)
+	if sg == nil {
+		return []NameSuggestion{}
+	}
+	path, ok := suggestFilePath(ns, loc, typ)
+	if !ok {
+		return sg.suggestions
+	}
+	f, err := OpenNameFile(path)
+	if err != nil {
+		s.logger.Error("error opening name file", zap.Error(err), zap.String(ZAP_PATH, path))
+		return sg.suggestions
+	}
+	defer f.Close()
+
+	lr := limitSuggestFile(f)
+	err = ScanNameLines(lr, func(lineNum int, content []byte, ending string) bool {
+		if lineNum%1024 == 0 && ctx.Err() != nil {
+			return false
+		}
+		name := string(content)
+		if loc.HasAttributes(typ) {
+			name = NameColumn(name)
+		}
+		sg.Add(name)
+		return true
+	})
+	if err != nil {
+		s.logger.Error("error reading name file", zap.Error(err), zap.String(ZAP_PATH, path))
+	} else if lr.N == 0 {
+		return []NameSuggestion{} // too large
+	}
+	return sg.suggestions
+}
+
+// betterSuggestion returns whether a should be suggested before b: closest first, then ones that sound the same, then alphabetically.
+func betterSuggestion(a, b NameSuggestion) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Phonetic != b.Phonetic {
+		return a.Phonetic
+	}
+	return a.Name < b.Name
+}
+
+// SuggestLocations returns the locations with the most names matching the query, out of those an extended search
+// would cover (so not loc or its related locations). Only the name column is matched, and only the name file
+// NameFilePath chose for each location is read, up to MAX_SUGGEST_MATCHES matches.
+func (s *Server) SuggestLocations(ctx context.Context, ns *NameState, query string, loc *Location, typ EntryType) []LocationSuggestion {
+	suggestions := []LocationSuggestion{}
+	re, err := CompileQuery(query)
+	if err != nil {
+		return suggestions // the search itself will have reported it
+	}
+
+	plain, native := extendedFiles(ns, loc, typ, false)
+	if len(plain) > 0 {
+		args, paths := extendedArgs(plain)
+		args = append(args, "--count", "-m", strconv.Itoa(MAX_SUGGEST_MATCHES), "-e", query)
+		ok := s.runRipgrep(ctx, append(args, paths...), query, func(l string) bool {
+			i := strings.IndexByte(l, 0)
+			if i == -1 {
+				return true
+			}
+			location, ok := plain[l[:i]]
+			num, err := strconv.Atoi(l[i+1:])
+			if ok && err == nil && num > 0 {
+				suggestions = append(suggestions, LocationSuggestion{Location: location, NumMatches: num})
+			}
+			return true
+		})
+		if !ok {
+			return []LocationSuggestion{}
+		}
+	}
+	// Files with attribute columns are counted separately, as rg would count matches in any column
+	for _, l := range native {
+		if ctx.Err() != nil {
+			break
+		}
+		num := 0
+		s.scanNameFile(ctx, ns, l, typ, func(line, rel string, lineNum int) bool {
+			if re.MatchString(NameColumn(line)) {
+				num++
+			}
+			return num < MAX_SUGGEST_MATCHES
+		})
+		if num > 0 {
+			suggestions = append(suggestions, LocationSuggestion{Location: l, NumMatches: num})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.NumMatches != b.NumMatches {
+			return a.NumMatches > b.NumMatches
+		}
+		return a.Location.Abbr < b.Location.Abbr
+	})
+	if len(suggestions) > NUM_SUGGESTIONS {
+		suggestions = suggestions[:NUM_SUGGESTIONS]
+	}
+	return suggestions
+}
+
+// EditDistance returns the Levenshtein distance between a and b, or max+1 if it's more than max.
+func EditDistance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	if prev[len(b)] > max {
+		return max + 1
+	}
+	return prev[len(b)]
+}
+
+// SOUNDEX_CODES are the digits of each consonant in Soundex. Other letters are ignored.
+var SOUNDEX_CODES = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3',
+	'l': '4',
+	'm': '5', 'n': '5',
+	'r': '6',
+}
+
+// Soundex returns the Soundex code of a word (like "R163" for "Robert"), or "" if it doesn't start with a Latin letter.
+func Soundex(word string) string {
+	code := []byte{}
+	var last byte
+	for _, r := range strings.ToLower(word) {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			if len(code) == 0 {
+				return ""
+			}
+			continue
+		}
+		digit := SOUNDEX_CODES[r]
+		if len(code) == 0 {
+			code = append(code, byte(unicode.ToUpper(r)))
+			last = digit
+			continue
+		}
+		if r == 'h' || r == 'w' {
+			continue // doesn't separate letters with the same code
+		}
+		if digit != 0 && digit != last {
+			code = append(code, digit)
+			if len(code) == 4 {
+				break
+			}
+		}
+		last = digit
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// suggestingResultWriter writes the results as {"search_id", "results", "suggestions"}, only suggesting if there weren't any results.
+type suggestingResultWriter struct {
+	w        io.Writer
+	results  *jsonResultWriter
+	searchID uuid.UUID
+	suggest  func() *Suggestions
+	started  bool
+	num      int
+}
+
+// NewSuggestingResultWriter sets the headers for a JSON object of results, calling suggest if there aren't any.
+func NewSuggestingResultWriter(w http.ResponseWriter, searchID uuid.UUID, suggest func() *Suggestions) ResultWriter {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	return &suggestingResultWriter{w: w, results: &jsonResultWriter{w: w, flusher: flusher}, searchID: searchID, suggest: suggest}
+}
+
+func (sw *suggestingResultWriter) start() error {
+	if sw.started {
+		return nil
+	}
+	sw.started = true
+	_, err := io.WriteString(sw.w, `{"search_id":"`+sw.searchID.String()+`","results":`)
+	return err
+}
+
+func (sw *suggestingResultWriter) Write(e Entry) error {
+	if err := sw.start(); err != nil {
+		return err
+	}
+	sw.num++
+	return sw.results.Write(e)
+}
+
+func (sw *suggestingResultWriter) Flush() {
+	sw.results.Flush()
+}
+
+func (sw *suggestingResultWriter) Close() error {
+	if err := sw.start(); err != nil {
+		return err
+	}
+	if err := sw.results.Close(); err != nil {
+		return err
+	}
+	if sw.num == 0 {
+		enc, err := json.Marshal(sw.suggest())
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(sw.w, `,"suggestions":`+string(enc)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(sw.w, "}")
+	return err
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// Script is a writing system that names can be written in.
+type Script string
+
+// Scripts
+const (
+	SC_LATIN    Script = "latin"
+	SC_CYRILLIC Script = "cyrillic"
+	SC_GREEK    Script = "greek"
+	SC_HEBREW   Script = "hebrew"
+	SC_ARABIC   Script = "arabic"
+)
+
+// SCRIPT_TABLES are the Unicode ranges of each Script.
+var SCRIPT_TABLES = map[Script]*unicode.RangeTable{
+	SC_LATIN:    unicode.Latin,
+	SC_CYRILLIC: unicode.Cyrillic,
+	SC_GREEK:    unicode.Greek,
+	SC_HEBREW:   unicode.Hebrew,
+	SC_ARABIC:   unicode.Arabic,
+}
+
+// NewScript creates a Script from a string.
+func NewScript(script string) (Script, bool) {
+	sc := Script(strings.ToLower(strings.TrimSpace(script)))
+	_, ok := SCRIPT_TABLES[sc]
+	return sc, ok
+}
+
+// ScriptOf returns the Script of a letter, or "" if it isn't in any of them.
+func ScriptOf(r rune) Script {
+	for sc, table := range SCRIPT_TABLES {
+		if unicode.Is(table, r) {
+			return sc
+		}
+	}
+	return ""
+}
+
+// TranslitRule maps a letter of a script to the ways it can be written in Latin letters, the first being preferred.
+// A rule with a blank Native lists Latin letters that have no equivalent, and may be left out (like vowels in Hebrew).
+type TranslitRule struct {
+	Native string
+	Latin  []string
+}
+
+// ABJAD_VOWELS matches the vowels that an abjad leaves unwritten, when converting it to Latin.
+const ABJAD_VOWELS = "[aeiouy]*"
+
+// Transliteration converts queries between a Script and Latin letters.
+type Transliteration struct {
+	Script Script
+	Abjad  bool // only consonants are written, so vowels may be anywhere in the Latin form
+
+	rules     []TranslitRule
+	toLatin   map[rune][]string
+	fromLatin map[string][]string // Latin -> native letters, "" if it may be left out
+	maxLatin  int                 // the longest key of fromLatin, in runes
+}
+
+// NewTransliteration creates a Transliteration from its rules. Later rules for the same letter replace earlier ones.
+func NewTransliteration(script Script, abjad bool, rules []TranslitRule) *Transliteration {
+	t := &Transliteration{Script: script, Abjad: abjad}
+	t.rules = append(t.rules, rules...)
+
+	byNative := make(map[string]int)
+	merged := []TranslitRule{}
+	for _, rule := range rules {
+		if i, ok := byNative[rule.Native]; ok {
+			merged[i] = rule
+			continue
+		}
+		byNative[rule.Native] = len(merged)
+		merged = append(merged, rule)
+	}
+
+	t.toLatin = make(map[rune][]string)
+	t.fromLatin = make(map[string][]string)
+	for _, rule := range merged {
+		if rule.Native != "" {
+			r, _ := utf8.DecodeRuneInString(rule.Native)
+			t.toLatin[r] = rule.Latin
+		}
+		for _, latin := range rule.Latin {
+			if latin == "" {
+				continue
+			}
+			t.fromLatin[latin] = append(t.fromLatin[latin], rule.Native)
+			if n := utf8.RuneCountInString(latin); n > t.maxLatin {
+				t.maxLatin = n
+			}
+		}
+	}
+	return t
+}
+
+// With returns a copy of the Transliteration with more rules added, replacing any for the same letters.
+func (t *Transliteration) With(rules []TranslitRule) *Transliteration {
+	if len(rules) == 0 {
+		return t
+	}
+	return NewTransliteration(t.Script, t.Abjad, append(append([]TranslitRule{}, t.rules...), rules...))
+}
+
+// ToLatin converts the literal text of a query from the Script to Latin letters.
+func (t *Transliteration) ToLatin(q string) string {
+	return MapLiterals(q, func(lit string) string {
+		var b strings.Builder
+		vowels := false // whether ABJAD_VOWELS was just written
+		for _, r := range strings.ToLower(lit) {
+			latin, ok := t.toLatin[r]
+			if !ok {
+				b.WriteString(regexp.QuoteMeta(string(r)))
+				vowels = false
+				continue
+			}
+			alt := Alternation(latin)
+			if t.Abjad {
+				if alt != "" || !vowels {
+					b.WriteString(alt)
+					b.WriteString(ABJAD_VOWELS)
+				}
+				vowels = true
+				continue
+			}
+			b.WriteString(alt)
+		}
+		return b.String()
+	})
+}
+
+// FromLatin converts the literal text of a query from Latin letters to the Script, preferring the longest matches (so "sh" before "s").
+func (t *Transliteration) FromLatin(q string) string {
+	return MapLiterals(q, func(lit string) string {
+		var b strings.Builder
+		runes := []rune(strings.ToLower(lit))
+		for i := 0; i < len(runes); {
+			n := t.maxLatin
+			if n > len(runes)-i {
+				n = len(runes) - i
+			}
+			for ; n > 0; n-- {
+				if natives, ok := t.fromLatin[string(runes[i:i+n])]; ok {
+					b.WriteString(Alternation(natives))
+					break
+				}
+			}
+			if n == 0 {
+				b.WriteString(regexp.QuoteMeta(string(runes[i])))
+				n = 1
+			}
+			i += n
+		}
+		return b.String()
+	})
+}
+
+// Alternation returns a regular expression matching any of alts. A blank alternative makes the whole thing optional.
+func Alternation(alts []string) string {
+	optional := false
+	seen := make(map[string]bool)
+	quoted := []string{}
+	singleRunes := true
+	for _, alt := range alts {
+		if alt == "" {
+			optional = true
+			continue
+		}
+		if seen[alt] {
+			continue
+		}
+		seen[alt] = true
+		quoted = append(quoted, regexp.QuoteMeta(alt))
+		if utf8.RuneCountInString(alt) != 1 {
+			singleRunes = false
+		}
+	}
+
+	var re string
+	switch {
+	case len(quoted) == 0:
+		return ""
+	case len(quoted) == 1 && singleRunes:
+		re = quoted[0]
+	case singleRunes:
+		re = "[" + strings.Join(quoted, "") + "]"
+	default:
+		re = "(?:" + strings.Join(quoted, "|") + ")"
+	}
+	if optional {
+		if len(quoted) == 1 && !singleRunes {
+			re = "(?:" + re + ")"
+		}
+		re += "?"
+	}
+	return re
+}
+
+// MapLiterals calls fn on each run of literal text in a regular expression, replacing it with the result.
+// Escapes, character classes, repetitions, groups, and other syntax are left as they are.
+func MapLiterals(q string, fn func(lit string) string) string {
+	var b strings.Builder
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			b.WriteString(fn(lit.String()))
+			lit.Reset()
+		}
+	}
+	// copyUntil copies q[i:] up to and including the first end after skip bytes, returning the index after it.
+	copyUntil := func(i, skip int, end byte) int {
+		j := i + skip
+		for j < len(q) && q[j] != end {
+			if q[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j < len(q) {
+			j++
+		}
+		b.WriteString(q[i:j])
+		return j
+	}
+
+	for i := 0; i < len(q); {
+		switch c := q[i]; {
+		case c == '\\':
+			flush()
+			if i+2 < len(q) && strings.IndexByte("pPx", q[i+1]) >= 0 && q[i+2] == '{' {
+				i = copyUntil(i, 2, '}')
+			} else {
+				_, size := utf8.DecodeRuneInString(q[i+1:])
+				b.WriteString(q[i : i+1+size])
+				i += 1 + size
+			}
+		case c == '[':
+			flush()
+			end := ClassEnd(q, i) // skipping over escapes and [:classes:], which copyUntil can't
+			b.WriteString(q[i:end])
+			i = end
+		case c == '{':
+			flush()
+			i = copyUntil(i, 1, '}')
+		case c == '(' && strings.HasPrefix(q[i:], "(?"):
+			flush()
+			// Flags or a group name, up to the ':' or ')'
+			j := i + 2
+			end := byte(':')
+			if strings.HasPrefix(q[j:], "P<") {
+				end = '>'
+			}
+			for j < len(q) && q[j] != end && q[j] != ')' {
+				j++
+			}
+			if j < len(q) {
+				j++
+			}
+			b.WriteString(q[i:j])
+			i = j
+		case strings.IndexByte(".^$*+?()|", c) >= 0:
+			flush()
+			b.WriteByte(c)
+			i++
+		default:
+			_, size := utf8.DecodeRuneInString(q[i:])
+			lit.WriteString(q[i : i+size])
+			i += size
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// QueryScript returns the Script of the letters in a query: the first one that isn't Latin, otherwise Latin.
+// It returns "" if the query has no letters.
+func QueryScript(q string) Script {
+	found := Script("")
+	MapLiterals(q, func(lit string) string {
+		for _, r := range lit {
+			if found != "" && found != SC_LATIN {
+				break
+			}
+			if sc := ScriptOf(r); sc != "" && unicode.IsLetter(r) {
+				found = sc
+			}
+		}
+		return lit
+	})
+	return found
+}
+
+// QueryVariant is a form of a query in another Script.
+type QueryVariant struct {
+	Script Script `json:"script"`
+	Query  string `json:"query"`
+
+	re *regexp.Regexp
+}
+
+// Transliterate returns the forms of a query in each of the location's scripts, other than the one it's written in.
+func (loc *Location) Transliterate(query string) []QueryVariant {
+	from := QueryScript(query)
+	if from == "" {
+		return nil
+	}
+
+	latin := query
+	if from != SC_LATIN {
+		latin = loc.Transliterations[from].ToLatin(query)
+	}
+
+	variants := []QueryVariant{}
+	for _, to := range loc.AllScripts() {
+		if to == from {
+			continue
+		}
+		v := QueryVariant{Script: to, Query: latin}
+		if to != SC_LATIN {
+			v.Query = loc.Transliterations[to].FromLatin(latin)
+		}
+		if v.Query != query {
+			variants = append(variants, v)
+		}
+	}
+	return variants
+}
+
+// MatchVariant returns the Script of the first variant that matches an entry, or "" if none do.
+func MatchVariant(variants []QueryVariant, e Entry) Script {
+	for _, v := range variants {
+		if v.re == nil {
+			continue
+		}
+		if v.re.MatchString(e.Name) {
+			return v.Script
+		}
+		for _, attr := range e.Attributes {
+			if v.re.MatchString(attr) {
+				return v.Script
+			}
+		}
+	}
+	return ""
+}
+
+// DEFAULT_TRANSLITERATIONS are the built-in rules for each Script, which can be changed (for every location or just one) in the transliterations table.
+var DEFAULT_TRANSLITERATIONS = map[Script]*Transliteration{
+	SC_CYRILLIC: NewTransliteration(SC_CYRILLIC, false, []TranslitRule{
+		{"а", []string{"a"}}, {"б", []string{"b"}}, {"в", []string{"v", "w"}}, {"г", []string{"g", "h"}},
+		{"ґ", []string{"g"}}, {"д", []string{"d"}}, {"е", []string{"e", "ye", "je"}}, {"ё", []string{"yo", "jo", "e"}},
+		{"є", []string{"ye", "je", "ie"}}, {"ж", []string{"zh", "z"}}, {"з", []string{"z"}}, {"и", []string{"i", "y"}},
+		{"і", []string{"i"}}, {"ї", []string{"yi", "ji", "i"}}, {"й", []string{"y", "j", "i"}}, {"к", []string{"k"}},
+		{"л", []string{"l"}}, {"м", []string{"m"}}, {"н", []string{"n"}}, {"о", []string{"o"}},
+		{"п", []string{"p"}}, {"р", []string{"r"}}, {"с", []string{"s"}}, {"т", []string{"t"}},
+		{"у", []string{"u"}}, {"ф", []string{"f"}}, {"х", []string{"kh", "h", "ch"}}, {"ц", []string{"ts", "tz", "c"}},
+		{"ч", []string{"ch", "tsch"}}, {"ш", []string{"sh", "sch"}}, {"щ", []string{"shch", "sch"}}, {"ъ", []string{""}},
+		{"ы", []string{"y"}}, {"ь", []string{""}}, {"э", []string{"e"}}, {"ю", []string{"yu", "ju", "iu"}},
+		{"я", []string{"ya", "ja", "ia"}},
+	}),
+	SC_GREEK: NewTransliteration(SC_GREEK, false, []TranslitRule{
+		{"α", []string{"a"}}, {"ά", []string{"a"}}, {"β", []string{"v", "b"}}, {"γ", []string{"g"}},
+		{"δ", []string{"d"}}, {"ε", []string{"e"}}, {"έ", []string{"e"}}, {"ζ", []string{"z"}},
+		{"η", []string{"i", "e"}}, {"ή", []string{"i", "e"}}, {"θ", []string{"th"}}, {"ι", []string{"i"}},
+		{"ί", []string{"i"}}, {"ϊ", []string{"i"}}, {"ΐ", []string{"i"}}, {"κ", []string{"k", "c"}},
+		{"λ", []string{"l"}}, {"μ", []string{"m"}}, {"ν", []string{"n"}}, {"ξ", []string{"x", "ks"}},
+		{"ο", []string{"o"}}, {"ό", []string{"o"}}, {"π", []string{"p"}}, {"ρ", []string{"r"}},
+		{"σ", []string{"s"}}, {"ς", []string{"s"}}, {"τ", []string{"t"}}, {"υ", []string{"y", "u", "i"}},
+		{"ύ", []string{"y", "u", "i"}}, {"ϋ", []string{"y", "i"}}, {"ΰ", []string{"y", "i"}}, {"φ", []string{"f", "ph"}},
+		{"χ", []string{"ch", "kh", "h"}}, {"ψ", []string{"ps"}}, {"ω", []string{"o"}}, {"ώ", []string{"o"}},
+	}),
+	SC_HEBREW: NewTransliteration(SC_HEBREW, true, []TranslitRule{
+		{"", []string{"a", "e", "i", "o", "u"}},
+		{"א", []string{"", "a", "e"}}, {"ב", []string{"b", "v"}}, {"ג", []string{"g"}}, {"ד", []string{"d"}},
+		{"ה", []string{"h", ""}}, {"ו", []string{"v", "w", "o", "u"}}, {"ז", []string{"z"}}, {"ח", []string{"ch", "kh", "h"}},
+		{"ט", []string{"t"}}, {"י", []string{"y", "j", "i", "e"}}, {"כ", []string{"k", "ch", "kh"}}, {"ך", []string{"k", "ch", "kh"}},
+		{"ל", []string{"l"}}, {"מ", []string{"m"}}, {"ם", []string{"m"}}, {"נ", []string{"n"}},
+		{"ן", []string{"n"}}, {"ס", []string{"s"}}, {"ע", []string{""}}, {"פ", []string{"p", "f"}},
+		{"ף", []string{"f", "p"}}, {"צ", []string{"ts", "tz", "z"}}, {"ץ", []string{"ts", "tz", "z"}}, {"ק", []string{"k", "q"}},
+		{"ר", []string{"r"}}, {"ש", []string{"sh", "s"}}, {"ת", []string{"t", "th"}},
+	}),
+	SC_ARABIC: NewTransliteration(SC_ARABIC, true, []TranslitRule{
+		{"", []string{"a", "e", "i", "o", "u"}},
+		{"ا", []string{"a", ""}}, {"أ", []string{"a", ""}}, {"إ", []string{"i", "e", ""}}, {"آ", []string{"a"}},
+		{"ء", []string{""}}, {"ؤ", []string{""}}, {"ئ", []string{""}}, {"ب", []string{"b"}},
+		{"ت", []string{"t"}}, {"ث", []string{"th"}}, {"ج", []string{"j", "g", "dj"}}, {"ح", []string{"h"}},
+		{"خ", []string{"kh"}}, {"د", []string{"d"}}, {"ذ", []string{"dh", "z"}}, {"ر", []string{"r"}},
+		{"ز", []string{"z"}}, {"س", []string{"s"}}, {"ش", []string{"sh"}}, {"ص", []string{"s"}},
+		{"ض", []string{"d"}}, {"ط", []string{"t"}}, {"ظ", []string{"z"}}, {"ع", []string{""}},
+		{"غ", []string{"gh"}}, {"ف", []string{"f"}}, {"ق", []string{"q", "k"}}, {"ك", []string{"k"}},
+		{"ل", []string{"l"}}, {"م", []string{"m"}}, {"ن", []string{"n"}}, {"ه", []string{"h"}},
+		{"و", []string{"w", "u", "o"}}, {"ي", []string{"y", "i", "e"}}, {"ى", []string{"a"}}, {"ة", []string{"a", "h"}},
+	}),
+}
+
+// loadTransliterations sets the Transliterations of each location: the defaults, changed by any rules in the database for every location, then by those for the location itself.
+func (s *Server) loadTransliterations(locations map[int]*Location) {
+	global := make(map[Script][]TranslitRule)
+	local := make(map[int]map[Script][]TranslitRule)
+
+	rows, _ := s.conn.Query(context.Background(), "SELECT COALESCE(location_id, 0), script, native, latin FROM transliterations ORDER BY id")
+	defer rows.Close()
+	for rows.Next() {
+		var locationID int
+		var script, native, latin string
+		if err := rows.Scan(&locationID, &script, &native, &latin); err != nil {
+			s.logger.Error("error reading transliterations", zap.Error(err))
+			continue
+		}
+		sc, ok := NewScript(script)
+		if !ok || sc == SC_LATIN || utf8.RuneCountInString(native) > 1 {
+			s.logger.Warn("invalid transliteration", zap.String("script", script), zap.String("native", native))
+			continue
+		}
+		rule := TranslitRule{Native: strings.ToLower(native), Latin: strings.Split(strings.ToLower(latin), ",")}
+
+		if locationID == 0 {
+			global[sc] = append(global[sc], rule)
+			continue
+		}
+		if local[locationID] == nil {
+			local[locationID] = make(map[Script][]TranslitRule)
+		}
+		local[locationID][sc] = append(local[locationID][sc], rule)
+	}
+
+	defaults := make(map[Script]*Transliteration)
+	for sc, t := range DEFAULT_TRANSLITERATIONS {
+		defaults[sc] = t.With(global[sc])
+	}
+	for id, loc := range locations {
+		loc.Transliterations = make(map[Script]*Transliteration)
+		for sc, t := range defaults {
+			loc.Transliterations[sc] = t.With(local[id][sc])
+		}
+	}
+}
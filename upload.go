@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// UploadResult is returned after a name file has been uploaded.
+type UploadResult struct {
+	Location string    `json:"location"`
+	Type     EntryType `json:"type"`
+	Entries  int64     `json:"entries"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// CopyNameFile copies a name file from src to dst, checking that it is valid UTF-8 (without a BOM) and uses a single style of line endings.
+// It returns the number of entries (non-blank lines) and bytes copied.
+func CopyNameFile(dst io.Writer, src io.Reader) (int64, int64, error) {
+	// A line must fit in the buffer, so a file without line endings can't use up memory
+	reader := bufio.NewReaderSize(src, MAX_LINE_LENGTH)
+	var entries, written int64
+	lineEnding := ""
+
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadSlice('\n') // only valid until the next read
+		if err == bufio.ErrBufferFull {
+			return entries, written, fmt.Errorf("line %d: longer than %d bytes", lineNum, MAX_LINE_LENGTH)
+		}
+		if len(line) > 0 {
+			content, ending := SplitLineEnding(line)
+			if lineNum == 1 && bytes.HasPrefix(content, UTF8_BOM) {
+				return entries, written, fmt.Errorf("line %d: file starts with a byte order mark", lineNum)
+			}
+			if !utf8.Valid(content) {
+				return entries, written, fmt.Errorf("line %d: invalid UTF-8", lineNum)
+			}
+			if bytes.IndexByte(content, '\r') != -1 {
+				return entries, written, fmt.Errorf("line %d: stray carriage return", lineNum)
+			}
+			if ending != "" {
+				if lineEnding == "" {
+					lineEnding = ending
+				} else if ending != lineEnding {
+					return entries, written, fmt.Errorf("line %d: mixed CRLF and LF line endings", lineNum)
+				}
+			}
+			if len(bytes.TrimSpace(content)) > 0 {
+				entries++
+			}
+
+			n, writeErr := dst.Write(line)
+			written += int64(n)
+			if writeErr != nil {
+				return entries, written, writeErr
+			}
+		}
+
+		if err == io.EOF {
+			return entries, written, nil
+		} else if err != nil {
+			return entries, written, err
+		}
+	}
+}
+
+// UTF8_BOM is the byte order mark some editors put at the start of UTF-8 files.
+var UTF8_BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// SplitLineEnding splits a line into its content and its line ending ("\r\n", "\n", or "" for the last line).
+func SplitLineEnding(line []byte) ([]byte, string) {
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return line[:len(line)-2], "\r\n"
+	} else if bytes.HasSuffix(line, []byte("\n")) {
+		return line[:len(line)-1], "\n"
+	}
+	return line, ""
+}
+
+// countingReadCloser counts the bytes read through it.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// UploadHandler replaces the name file of a location and entry type with the request body
+// (or the 'file' field of a multipart form), then refreshes that location.
+// Versions are published as a whole and can be rolled back to, so uploads are refused while the names folder is versioned.
+func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(MarshalError("upload with POST or PUT"))
+		return
+	}
+	if IsVersioned() {
+		w.WriteHeader(http.StatusConflict)
+		w.Write(MarshalError(ErrVersioned.Error()))
+		return
+	}
+
+	params := r.URL.Query()
+	locations, ok := params["location"]
+	if !ok || len(locations) < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("no 'location' parameter provided"))
+		return
+	}
+
+	entryTypes, ok := params["entry_type"]
+	if !ok || len(entryTypes) < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("no 'entry_type' parameter provided"))
+		return
+	}
+
+	ns := s.Names()
+	location, ok := ns.LookupLocationByAbbr(locations[0])
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid location"))
+		return
+	}
+
+	entryType, ok := NewEntryType(entryTypes[0])
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("invalid type"))
+		return
+	}
+
+	// The error of http.MaxBytesReader can't be told apart from others, so how much was read is counted instead
+	counter := &countingReadCloser{ReadCloser: http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)}
+	r.Body = counter
+	tooLarge := func() bool {
+		if counter.n < s.config.MaxUploadSize {
+			return false
+		}
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(MarshalError(fmt.Sprintf("file larger than %d bytes", s.config.MaxUploadSize)))
+		return true
+	}
+
+	var body io.Reader = r.Body
+	if mr, err := r.MultipartReader(); err == nil {
+		body = nil
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if part.FormName() == "file" {
+				body = part
+				break
+			}
+		}
+		if body == nil {
+			if tooLarge() {
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(MarshalError("no 'file' field in form"))
+			return
+		}
+	}
+
+	folder := filepath.Join(ns.Folder, location.Folder())
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		s.logger.Error("error creating location folder", zap.Error(err), zap.String(ZAP_PATH, folder))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+
+	result := UploadResult{Location: location.Abbr, Type: entryType}
+	var validationErr error
+	path := filepath.Join(folder, FileName(location, entryType))
+	err := WriteFileAtomic(path, func(tmp io.Writer) error {
+		result.Entries, result.Bytes, validationErr = CopyNameFile(tmp, body)
+		return validationErr
+	})
+	if validationErr != nil {
+		s.logger.Warn("rejected upload", zap.Error(validationErr), zap.Object(ZAP_LOCATION, location))
+		if tooLarge() {
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError(validationErr.Error()))
+		return
+	} else if err != nil {
+		s.logger.Error("error writing upload", zap.Error(err), zap.String(ZAP_PATH, path))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+
+	s.logger.Info("uploaded name file", zap.String(ZAP_PATH, path), zap.Int64("entries", result.Entries))
+
+	// Remove any compressed copies, which would otherwise still be searched by extended searches
+	for _, name := range NameFileNames(location, entryType)[1:] {
+		if err := os.Remove(filepath.Join(folder, name)); err != nil && !os.IsNotExist(err) {
+			s.logger.Error("error removing old compressed name file", zap.Error(err), zap.String(ZAP_PATH, name))
+		}
+	}
+	s.RefreshLocations([]*Location{location})
+
+	enc, err := json.Marshal(result)
+	if err != nil {
+		s.logger.DPanic("error encoding upload result", zap.Error(err))
+	}
+	w.Write(enc)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Dataset versions live side by side in NAME_FOLDER/versions/<id>, each laid out like an unversioned names folder.
+// The history of activated versions (most recent, i.e. active, last) is kept in NAME_FOLDER/versions/.active.
+// Without a versions folder, NAME_FOLDER itself is used, as before.
+const (
+	VERSIONS_FOLDER      = "versions"
+	VERSION_HISTORY_FILE = ".active"
+	MAX_VERSION_HISTORY  = 50
+)
+
+var (
+	ErrNotVersioned      = errors.New("names folder isn't versioned")
+	ErrInvalidVersion    = errors.New("invalid version")
+	ErrNoPreviousVersion = errors.New("no previous version to roll back to")
+	ErrVersioned         = errors.New("names folder is versioned, so add a new version and activate it instead")
+)
+
+// VersionsInfo describes the available dataset versions.
+type VersionsInfo struct {
+	Versioned bool     `json:"versioned"`
+	Active    string   `json:"active"`
+	Versions  []string `json:"versions"`
+	History   []string `json:"history"` // most recent last
+}
+
+// IsVersioned returns whether NAME_FOLDER holds several dataset versions.
+func IsVersioned() bool {
+	fi, err := os.Stat(filepath.Join(NAME_FOLDER, VERSIONS_FOLDER))
+	return err == nil && fi.IsDir()
+}
+
+// VersionFolder returns the names folder of a version, and whether it exists.
+func VersionFolder(id string) (string, bool) {
+	if id == "" || IsTempFile(id) || strings.ContainsAny(id, `/\`) || id == ".." {
+		return "", false
+	}
+	folder := filepath.Join(NAME_FOLDER, VERSIONS_FOLDER, id)
+	fi, err := os.Stat(folder)
+	return folder, err == nil && fi.IsDir()
+}
+
+// ListVersions returns the IDs of every version, sorted.
+func ListVersions() ([]string, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(NAME_FOLDER, VERSIONS_FOLDER))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, de := range dirEntries {
+		if de.IsDir() && !IsTempFile(de.Name()) {
+			ids = append(ids, de.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ReadVersionHistory returns the IDs of the versions that have been activated, most recent last.
+func ReadVersionHistory() ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(NAME_FOLDER, VERSIONS_FOLDER, VERSION_HISTORY_FILE))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+// WriteVersionHistory atomically replaces the version history.
+func WriteVersionHistory(ids []string) error {
+	if len(ids) > MAX_VERSION_HISTORY {
+		ids = ids[len(ids)-MAX_VERSION_HISTORY:]
+	}
+	return WriteFileAtomic(filepath.Join(NAME_FOLDER, VERSIONS_FOLDER, VERSION_HISTORY_FILE), func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(ids, "\n")+"\n")
+		return err
+	})
+}
+
+// ActiveNameFolder returns the names folder that should be served: the most recently activated version that still exists,
+// or else the newest version, or NAME_FOLDER itself if it isn't versioned.
+func ActiveNameFolder() (string, error) {
+	if !IsVersioned() {
+		return NAME_FOLDER, nil
+	}
+
+	history, err := ReadVersionHistory()
+	if err != nil {
+		return "", err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if folder, ok := VersionFolder(history[i]); ok {
+			return folder, nil
+		}
+	}
+
+	ids, err := ListVersions()
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", errors.New("versions folder is empty")
+	}
+	folder, _ := VersionFolder(ids[len(ids)-1])
+	return folder, nil
+}
+
+// ActivateVersion switches the server to another dataset version.
+func (s *Server) ActivateVersion(id string) error {
+	return s.switchVersion(id, func(history []string) []string {
+		if len(history) > 0 && history[len(history)-1] == id {
+			return history // already active
+		}
+		return append(history, id)
+	})
+}
+
+// RollbackVersion switches the server back to the version that was active before the current one, returning its ID.
+func (s *Server) RollbackVersion() (string, error) {
+	history, err := ReadVersionHistory()
+	if err != nil {
+		return "", err
+	}
+	if len(history) < 2 {
+		return "", ErrNoPreviousVersion
+	}
+
+	id := history[len(history)-2]
+	return id, s.switchVersion(id, func(history []string) []string {
+		return history[:len(history)-1]
+	})
+}
+
+// switchVersion rebuilds everything derived from the names folder for a version, and only then swaps it in,
+// so searches are never served from a half-loaded version. updateHistory returns the new version history.
+func (s *Server) switchVersion(id string, updateHistory func([]string) []string) error {
+	if !IsVersioned() {
+		return ErrNotVersioned
+	}
+	folder, ok := VersionFolder(id)
+	if !ok {
+		return ErrInvalidVersion
+	}
+
+	s.refreshMux.Lock()
+	defer s.refreshMux.Unlock()
+
+	history, err := ReadVersionHistory()
+	if err != nil {
+		return err
+	}
+	newHistory := updateHistory(history)
+
+	if folder == s.Names().Folder {
+		// Already active, so there's nothing to load
+		if strings.Join(newHistory, "\n") == strings.Join(history, "\n") {
+			return nil
+		}
+		return WriteVersionHistory(newHistory)
+	}
+
+	s.logger.Info("loading version", zap.String("version", id), zap.String(ZAP_PATH, folder))
+	ns, err := s.LoadNameState(folder)
+	if err != nil {
+		return err
+	}
+	if err := WriteVersionHistory(newHistory); err != nil {
+		return err
+	}
+
+	// Swap, all at once
+	s.PublishNames(ns)
+	s.UpdateDiffs(folder, LocationList(ns.Locations))
+
+	s.logger.Info("activated version", zap.String("version", id))
+	return nil
+}
+
+// GetVersionsInfo returns the available and active versions.
+func (s *Server) GetVersionsInfo() (VersionsInfo, error) {
+	info := VersionsInfo{Versioned: IsVersioned(), Versions: []string{}, History: []string{}}
+	if !info.Versioned {
+		return info, nil
+	}
+
+	var err error
+	if info.Versions, err = ListVersions(); err != nil {
+		return info, err
+	}
+	if info.History, err = ReadVersionHistory(); err != nil {
+		return info, err
+	}
+	info.Active = filepath.Base(s.Names().Folder)
+	return info, nil
+}
+
+// VersionsHandler lists the dataset versions.
+func (s *Server) VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeVersionsInfo(w)
+}
+
+// ActivateVersionHandler switches to the version given by the 'id' parameter.
+func (s *Server) ActivateVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(MarshalError("activate with POST"))
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError("no 'id' parameter provided"))
+		return
+	}
+
+	if err := s.ActivateVersion(id); err != nil {
+		s.writeVersionError(w, err)
+		return
+	}
+	s.writeVersionsInfo(w)
+}
+
+// RollbackVersionHandler switches back to the previously active version.
+func (s *Server) RollbackVersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(MarshalError("roll back with POST"))
+		return
+	}
+
+	if _, err := s.RollbackVersion(); err != nil {
+		s.writeVersionError(w, err)
+		return
+	}
+	s.writeVersionsInfo(w)
+}
+
+func (s *Server) writeVersionError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotVersioned, ErrInvalidVersion, ErrNoPreviousVersion:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(MarshalError(err.Error()))
+	default:
+		s.logger.Error("error switching version", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+	}
+}
+
+func (s *Server) writeVersionsInfo(w http.ResponseWriter) {
+	info, err := s.GetVersionsInfo()
+	if err != nil {
+		s.logger.Error("error listing versions", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(MarshalError("internal error"))
+		return
+	}
+
+	enc, err := json.Marshal(info)
+	if err != nil {
+		s.logger.DPanic("error encoding versions", zap.Error(err))
+	}
+	w.Write(enc)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fileState is what the watcher remembers about a single file between polls.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// IsTempFile returns whether a file or folder name belongs to a sync in progress (or to Syncthing itself),
+// and so should never be treated as part of the names.
+func IsTempFile(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "."): // .stfolder, .stversions, .syncthing.*.tmp, our own upload temp files
+		return true
+	case strings.HasPrefix(name, "~syncthing~"): // Syncthing temp files on Windows-style setups
+		return true
+	case strings.HasSuffix(name, ".tmp"), strings.HasSuffix(name, ".partial"):
+		return true
+	}
+	return false
+}
+
+// ScanNameFolder returns the state of every name file, keyed by its path relative to the names folder.
+// Location folders are included too (with a zero fileState), so that added or removed locations are noticed.
+func ScanNameFolder(nameFolder string) (map[string]fileState, error) {
+	states := make(map[string]fileState)
+
+	dirEntries, err := os.ReadDir(nameFolder)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range dirEntries {
+		if !de.IsDir() || IsTempFile(de.Name()) {
+			continue
+		}
+		states[de.Name()] = fileState{}
+
+		files, err := os.ReadDir(filepath.Join(nameFolder, de.Name()))
+		if err != nil {
+			// The folder may have been removed since we listed it
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() || IsTempFile(f.Name()) {
+				continue
+			}
+			fi, err := f.Info()
+			if err != nil {
+				continue
+			}
+			states[filepath.Join(de.Name(), f.Name())] = fileState{size: fi.Size(), modTime: fi.ModTime()}
+		}
+	}
+	return states, nil
+}
+
+// WatchNames polls the names folder for changes, and once they have settled refreshes whatever they affect.
+// It never returns, so should be run in its own goroutine.
+func (s *Server) WatchNames() {
+	nameFolder := s.Names().Folder
+	s.logger.Info("watching names folder",
+		zap.String(ZAP_PATH, nameFolder),
+		zap.Duration("interval", s.config.WatchInterval),
+		zap.Duration("debounce", s.config.WatchDebounce))
+
+	prev, err := ScanNameFolder(nameFolder)
+	if err != nil {
+		s.logger.Error("error scanning names folder", zap.Error(err))
+	}
+
+	pending := make(map[string]bool) // changed paths that haven't been refreshed yet
+	var lastChange time.Time
+
+	ticker := time.NewTicker(s.config.WatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if active := s.Names().Folder; nameFolder != active {
+			// A different version was activated, which has already been fully refreshed
+			nameFolder = active
+			prev, _ = ScanNameFolder(nameFolder)
+			pending = make(map[string]bool)
+			s.logger.Info("watching names folder", zap.String(ZAP_PATH, nameFolder))
+			continue
+		}
+
+		cur, err := ScanNameFolder(nameFolder)
+		if err != nil {
+			s.logger.Error("error scanning names folder", zap.Error(err))
+			continue
+		}
+
+		for path, state := range cur {
+			if old, ok := prev[path]; !ok || old != state {
+				pending[path] = true
+				lastChange = time.Now()
+			}
+		}
+		for path := range prev {
+			if _, ok := cur[path]; !ok {
+				pending[path] = true
+				lastChange = time.Now()
+			}
+		}
+		prev = cur
+
+		// Wait until a burst of changes is over before refreshing
+		if len(pending) == 0 || time.Since(lastChange) < s.config.WatchDebounce {
+			continue
+		}
+
+		s.RefreshPaths(pending)
+		pending = make(map[string]bool)
+	}
+}
+
+// RefreshPaths refreshes the state affected by the given changed paths (relative to the names folder).
+// A full refresh is only done when location folders themselves were added or removed.
+func (s *Server) RefreshPaths(paths map[string]bool) {
+	affected := make(map[int]*Location)
+	for path := range paths {
+		dir := strings.SplitN(filepath.ToSlash(path), "/", 2)
+		if len(dir) < 2 {
+			// A location folder was added or removed
+			s.logger.Info("location folders changed, doing a full refresh", zap.String(ZAP_PATH, path))
+			s.Refresh()
+			return
+		}
+
+		nl, ok := NewLocation(dir[0])
+		if !ok {
+			continue
+		}
+		loc, ok := s.Names().LookupLocationByAbbr(nl.Abbr)
+		if !ok {
+			// Shouldn't happen, as the folder would have shown up as new
+			s.logger.Info("unknown location changed, doing a full refresh", zap.String(ZAP_PATH, path))
+			s.Refresh()
+			return
+		}
+		affected[loc.ID] = loc
+	}
+
+	locs := []*Location{}
+	for _, loc := range affected {
+		locs = append(locs, loc)
+	}
+	if len(locs) > 0 {
+		s.RefreshLocations(locs)
+	}
+}